@@ -1,4 +1,5 @@
-// Package api Code generated by swaggo/swag. DO NOT EDIT
+// Code generated by swaggo/swag. DO NOT EDIT.
+
 package api
 
 import "github.com/swaggo/swag"
@@ -15,41 +16,183 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/debug/pool": {
+            "get": {
+                "description": "Snapshot of the database connection pool, for diagnosing connection exhaustion. Disabled with DEBUG_POOL_ENABLED=false.",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "debug"
+                ],
+                "summary": "Get connection pool statistics",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/repositories.PoolStats"
+                        }
+                    }
+                }
+            }
+        },
         "/subscriptions": {
             "get": {
-                "description": "Get list of subscriptions",
+                "description": "Get a page of subscriptions as {items, total, limit, offset}. start_date/end_date select subscriptions overlapping the period (as /subscriptions/total does); with exact_period=true they must match start_date/end_date exactly instead.",
                 "produces": [
-                    "application/json"
+                    "application/json",
+                    "application/msgpack"
                 ],
                 "tags": [
                     "subscriptions"
                 ],
                 "summary": "List subscriptions",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Service name",
+                        "name": "service_name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Case-insensitive substring of the service name (at most 255 characters); combined with service_name, both must match",
+                        "name": "service_name_like",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Period start in MM-YYYY",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Period end in MM-YYYY",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Match start_date/end_date exactly instead of by overlap",
+                        "name": "exact_period",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Add has_duplicate flag for overlapping subscriptions of the same user and service",
+                        "name": "annotate_duplicates",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only subscriptions created in the given billing cycle (current)",
+                        "name": "billing_cycle",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only subscriptions active in the given month (MM-YYYY or another format accepted for start_date)",
+                        "name": "active_on",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Minimum price, inclusive",
+                        "name": "min_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum price, inclusive",
+                        "name": "max_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sort field: id (default), price, start_date, service_name, or period_cost (price times months of overlap with start_date..end_date, requires both)",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sort order: asc or desc (default asc, desc for period_cost)",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma-separated computed fields to include (period, remaining)",
+                        "name": "with",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 50, at most 500)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of subscriptions to skip (default 0)",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "type": "object"
-                            }
+                            "type": "object"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     }
                 }
             },
             "post": {
-                "description": "Create a new subscription",
+                "description": "Create a new subscription. service_name is stored trimmed and lowercased, and service_name filters are matched the same way. price must be between 0 and MAX_PRICE. currency is an optional ISO 4217 code (3 uppercase letters, default USD). A subscription overlapping another one of the same user to the same service is rejected with 409.",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
-                    "application/json"
+                    "application/json",
+                    "application/msgpack"
                 ],
                 "tags": [
                     "subscriptions"
@@ -64,6 +207,18 @@ const docTemplate = `{
                         "schema": {
                             "type": "object"
                         }
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "End the user's active subscriptions to the same service at the new start date",
+                        "name": "close_previous",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making the request safe to retry: a repeat with the same key and request returns the original response for 24h",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -79,51 +234,63 @@ const docTemplate = `{
                     "400": {
                         "description": "Bad Request",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     }
                 }
-            }
-        },
-        "/subscriptions/total": {
-            "get": {
-                "description": "Calculate total sum of subscription prices for the given filters and period (optional filters: user_id, service_name, start_date, end_date in MM-YYYY)",
+            },
+            "delete": {
+                "description": "Soft-delete every subscription of the user, e.g. when offboarding them; each can be brought back with the restore endpoint. With dry_run=true nothing is deleted and the answer lists the subscriptions that would be deleted, as {\"would_delete\": N, \"subscriptions\": [...]}.",
                 "produces": [
-                    "application/json"
+                    "application/json",
+                    "application/msgpack"
                 ],
                 "tags": [
                     "subscriptions"
                 ],
-                "summary": "Get total cost",
+                "summary": "Delete all subscriptions of a user",
                 "parameters": [
                     {
                         "type": "string",
                         "description": "User ID",
                         "name": "user_id",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Service name",
-                        "name": "service_name",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Period start in MM-YYYY",
-                        "name": "start_date",
-                        "in": "query"
+                        "in": "query",
+                        "required": true
                     },
                     {
-                        "type": "string",
-                        "description": "Period end in MM-YYYY",
-                        "name": "end_date",
+                        "type": "boolean",
+                        "description": "Preview the deletion without deleting",
+                        "name": "dry_run",
                         "in": "query"
                     }
                 ],
@@ -140,124 +307,1089 @@ const docTemplate = `{
                     "400": {
                         "description": "Bad Request",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     }
                 }
             }
         },
-        "/subscriptions/{id}": {
-            "get": {
-                "description": "Get subscription by id",
-                "produces": [
+        "/subscriptions/batch": {
+            "post": {
+                "description": "Create all subscriptions of a JSON array in one transaction. Each element follows the rules of single create; if any element is rejected nothing is created and the errors name the offending index in their field, e.g. \"[3]\" or \"[3].end_date\".",
+                "consumes": [
                     "application/json"
                 ],
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
                 "tags": [
                     "subscriptions"
                 ],
-                "summary": "Get subscription by id",
+                "summary": "Create subscriptions in bulk",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "Subscription ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Subscriptions to create",
+                        "name": "subscriptions",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "object"
+                            }
+                        }
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
+                    "201": {
+                        "description": "Created",
                         "schema": {
-                            "type": "object"
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "array",
+                                "items": {
+                                    "type": "integer"
+                                }
+                            }
                         }
                     },
                     "400": {
                         "description": "Bad Request",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     },
-                    "404": {
-                        "description": "Not Found",
+                    "409": {
+                        "description": "Conflict",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     }
                 }
-            },
-            "put": {
-                "description": "Update subscription fields partially",
-                "consumes": [
-                    "application/json"
+            }
+        },
+        "/subscriptions/by-external/{external_id}": {
+            "get": {
+                "description": "Get the subscription identified by its external billing system id",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
                 ],
                 "tags": [
                     "subscriptions"
                 ],
-                "summary": "Update subscription by id",
+                "summary": "Get subscription by external id",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "Subscription ID",
-                        "name": "id",
+                        "type": "string",
+                        "description": "External ID",
+                        "name": "external_id",
                         "in": "path",
                         "required": true
                     },
                     {
-                        "description": "Fields to update",
-                        "name": "subscription",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "type": "object"
-                        }
+                        "type": "string",
+                        "description": "Comma-separated computed fields to include (period, remaining)",
+                        "name": "with",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)",
+                        "name": "date_format",
+                        "in": "query"
                     }
                 ],
                 "responses": {
-                    "204": {
-                        "description": "No Content",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "type": "string"
+                            "type": "object"
                         }
                     },
                     "400": {
                         "description": "Bad Request",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     },
                     "404": {
                         "description": "Not Found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
                         }
                     }
                 }
             },
-            "delete": {
-                "description": "Delete subscription",
+            "put": {
+                "description": "Upsert the subscription with the given external id: the body replaces its fields when it exists, otherwise a new subscription is created. Responds 201 on create and 200 on update.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
                 "tags": [
                     "subscriptions"
                 ],
-                "summary": "Delete subscription by id",
+                "summary": "Create or update subscription by external id",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "External subscription ID",
+                        "name": "external_id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Subscription data (external_id may be omitted)",
+                        "name": "subscription",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "integer"
+                            }
+                        }
+                    },
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "integer"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/count": {
+            "get": {
+                "description": "Number of subscriptions matching the filters, without transferring the rows",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Count subscriptions",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Service name",
+                        "name": "service_name",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "integer"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/expiring": {
+            "get": {
+                "description": "Subscriptions whose end_date falls within the next N months, counting from the current month, ordered by end_date. Open-ended subscriptions are never listed.",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "List expiring subscriptions",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Number of months (default 1, at most MAX_MONTHS)",
+                        "name": "within",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma-separated computed fields to include (period, remaining)",
+                        "name": "with",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)",
+                        "name": "date_format",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "object"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/has-active": {
+            "get": {
+                "description": "Report whether the user has any subscription active in the given month",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Check for an active subscription",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Month in MM-YYYY (default current UTC month)",
+                        "name": "as_of",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "boolean"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/maintenance/normalize-dates": {
+            "post": {
+                "description": "Truncate start_date and end_date of all subscriptions to the first day of their month (admin maintenance). Only served when MAINTENANCE_ENABLED is true.",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "maintenance"
+                ],
+                "summary": "Normalize stored dates",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "integer"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/total": {
+            "get": {
+                "description": "Calculate the total cost of subscriptions for the given filters and period. With both start_date and end_date each subscription counts price x months active within the period; otherwise raw prices are summed (optional filters: user_id, repeated or comma-separated to sum the subscriptions of several users, service_name, has_service_name, start_date, end_date in MM-YYYY, exclude_service repeated for each service to leave out, currency, filter[column]=value for equality on user_id, service_name, status, currency, external_id or price). An absent or empty service_name applies no service filter; use has_service_name=false to select subscriptions whose service name is empty. Prices in different currencies are not added up: when the matching subscriptions use several currencies the request is rejected and currency must be given.",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Get total cost",
+                "parameters": [
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "User IDs, repeated or comma-separated; subscriptions of any of them are summed",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Service name",
+                        "name": "service_name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "true: only subscriptions with a service name; false: only those with an empty one",
+                        "name": "has_service_name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only subscriptions priced in this ISO 4217 currency",
+                        "name": "currency",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Period start in MM-YYYY",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Period end in MM-YYYY",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "Service names to exclude",
+                        "name": "exclude_service",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Minimum price, inclusive",
+                        "name": "min_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum price, inclusive",
+                        "name": "max_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Equality filter on a whitelisted column, e.g. filter[status]=active",
+                        "name": "filter[column]",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "integer"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/total/breakdown": {
+            "get": {
+                "description": "Total cost per service_name and currency, ordered by service name and currency, for the same filters and proration rules as /subscriptions/total",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Get total cost by service",
+                "parameters": [
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "User IDs, repeated or comma-separated",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Service name",
+                        "name": "service_name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "true: only subscriptions with a service name; false: only those with an empty one",
+                        "name": "has_service_name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only subscriptions priced in this ISO 4217 currency",
+                        "name": "currency",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Period start in MM-YYYY",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Period end in MM-YYYY",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "Service names to exclude",
+                        "name": "exclude_service",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Minimum price, inclusive",
+                        "name": "min_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum price, inclusive",
+                        "name": "max_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Equality filter on a whitelisted column, e.g. filter[status]=active",
+                        "name": "filter[column]",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/repositories.ServiceTotal"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/total/timeseries": {
+            "get": {
+                "description": "Total cost of the subscriptions active in each month from start_date to end_date, both required and inclusive, in chronological order; months without subscriptions have a total of 0. The period must not be inverted nor span more than MAX_MONTHS months. The other filters are those of /subscriptions/total, and so is the currency rule.",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Get monthly total cost time series",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "First month in MM-YYYY",
+                        "name": "start_date",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Last month in MM-YYYY",
+                        "name": "end_date",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "User IDs, repeated or comma-separated",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Service name",
+                        "name": "service_name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "true: only subscriptions with a service name; false: only those with an empty one",
+                        "name": "has_service_name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only subscriptions priced in this ISO 4217 currency",
+                        "name": "currency",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "Service names to exclude",
+                        "name": "exclude_service",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Minimum price, inclusive",
+                        "name": "min_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum price, inclusive",
+                        "name": "max_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Equality filter on a whitelisted column, e.g. filter[status]=active",
+                        "name": "filter[column]",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/repositories.MonthTotal"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/trend": {
+            "get": {
+                "description": "Total cost of active subscriptions for each of the last N months (including the current one), in chronological order. Prices in different currencies are not added up: when the subscriptions active in the window use several currencies the request is rejected and currency must be given.",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Get monthly cost trend",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Number of months (default 12, at most MAX_MONTHS)",
+                        "name": "months",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only subscriptions priced in this ISO 4217 currency",
+                        "name": "currency",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/repositories.MonthTotal"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/{id}": {
+            "get": {
+                "description": "Get subscription by id",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Get subscription by id",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Subscription ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma-separated computed fields to include (period, remaining)",
+                        "name": "with",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)",
+                        "name": "date_format",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Update subscription fields partially. PATCH and PUT are equivalent: PUT is kept for existing clients and is a partial update too, not a full replacement. With Content-Type application/merge-patch+json the body is an RFC 7386 merge patch: absent fields are unchanged and null clears a field (only end_date can be cleared). The update must name the subscription version it is based on, either in the If-Match header (the ETag returned by GET) or in the version field; the request is rejected with 409 when the subscription has been modified since, and with 428 when no version is given. The new version is returned in the ETag header. An invalid start_date or end_date is reported with the validation status and an error with code invalid_field naming the field and echoing the value.",
+                "consumes": [
+                    "application/json",
+                    "application/merge-patch+json"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Update subscription by id",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Subscription ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the version the update is based on, e.g. \\",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Fields to update",
+                        "name": "subscription",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "428": {
+                        "description": "Precondition Required",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Soft-delete subscription: it is kept for audits but no longer returned or counted, and can be brought back with the restore endpoint. With dry_run=true nothing is deleted and the subscription that would be deleted is returned with 200.",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Delete subscription by id",
                 "parameters": [
                     {
                         "type": "integer",
@@ -265,9 +1397,21 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Preview the deletion without deleting",
+                        "name": "dry_run",
+                        "in": "query"
                     }
                 ],
                 "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object"
+                        }
+                    },
                     "204": {
                         "description": "No Content",
                         "schema": {
@@ -276,16 +1420,453 @@ const docTemplate = `{
                     },
                     "404": {
                         "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "description": "Update subscription fields partially. PATCH and PUT are equivalent: PUT is kept for existing clients and is a partial update too, not a full replacement. With Content-Type application/merge-patch+json the body is an RFC 7386 merge patch: absent fields are unchanged and null clears a field (only end_date can be cleared). The update must name the subscription version it is based on, either in the If-Match header (the ETag returned by GET) or in the version field; the request is rejected with 409 when the subscription has been modified since, and with 428 when no version is given. The new version is returned in the ETag header. An invalid start_date or end_date is reported with the validation status and an error with code invalid_field naming the field and echoing the value.",
+                "consumes": [
+                    "application/json",
+                    "application/merge-patch+json"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Update subscription by id",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Subscription ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the version the update is based on, e.g. \\",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Fields to update",
+                        "name": "subscription",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content",
                         "schema": {
                             "type": "string"
                         }
                     },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "428": {
+                        "description": "Precondition Required",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/{id}/restore": {
+            "post": {
+                "description": "Bring back a subscription removed with DELETE /subscriptions/{id}",
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Restore subscription by id",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Subscription ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content",
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/{id}/tenure": {
+            "get": {
+                "description": "Number of whole months between the subscription start and as_of (default: current month), capped at end_date; 0 for subscriptions starting after as_of",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "Get subscription tenure",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Subscription ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Reference month in MM-YYYY (default current UTC month)",
+                        "name": "as_of",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{user_id}/subscriptions": {
+            "get": {
+                "description": "List a page of the subscriptions of one user, ordered by id",
+                "produces": [
+                    "application/json",
+                    "application/msgpack"
+                ],
+                "tags": [
+                    "subscriptions"
+                ],
+                "summary": "List subscriptions of a user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 50, at most 500)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of subscriptions to skip (default 0)",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma-separated computed fields to include (period, remaining)",
+                        "name": "with",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)",
+                        "name": "date_format",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/server.subscriptionsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/server.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "repositories.MonthTotal": {
+            "type": "object",
+            "properties": {
+                "month": {
+                    "type": "string"
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "repositories.PoolStats": {
+            "type": "object",
+            "properties": {
+                "acquire_count": {
+                    "type": "integer"
+                },
+                "acquire_duration_seconds": {
+                    "type": "number"
+                },
+                "acquired_conns": {
+                    "type": "integer"
+                },
+                "idle_conns": {
+                    "type": "integer"
+                },
+                "max_conns": {
+                    "type": "integer"
+                },
+                "total_conns": {
+                    "type": "integer"
+                }
+            }
+        },
+        "repositories.ServiceTotal": {
+            "type": "object",
+            "properties": {
+                "currency": {
+                    "type": "string"
+                },
+                "service_name": {
+                    "type": "string"
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "server.APIError": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string"
+                },
+                "field": {
+                    "type": "string"
+                },
+                "message": {
+                    "type": "string"
+                },
+                "value": {
+                    "type": "string"
+                }
+            }
+        },
+        "server.ErrorResponse": {
+            "type": "object",
+            "properties": {
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/server.APIError"
+                    }
+                },
+                "status": {
+                    "type": "integer"
+                }
+            }
+        },
+        "server.subscriptionResponse": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "currency": {
+                    "type": "string"
+                },
+                "end_date": {
+                    "type": "string"
+                },
+                "external_id": {
+                    "type": "string"
+                },
+                "has_duplicate": {
+                    "type": "boolean"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "months_remaining": {
+                    "description": "MonthsRemaining is only set when requested. It points to a nil *int\nfor open-ended subscriptions so they are encoded as null rather than\nomitted.",
+                    "type": "integer"
+                },
+                "period": {
+                    "type": "string"
+                },
+                "price": {
+                    "type": "integer"
+                },
+                "service_name": {
+                    "type": "string"
+                },
+                "start_date": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "server.subscriptionsPage": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/server.subscriptionResponse"
                     }
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "offset": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
                 }
             }
         }
@@ -302,8 +1883,6 @@ var SwaggerInfo = &swag.Spec{
 	Description:      "API for managing user subscriptions.",
 	InfoInstanceName: "swagger",
 	SwaggerTemplate:  docTemplate,
-	LeftDelim:        "{{",
-	RightDelim:       "}}",
 }
 
 func init() {
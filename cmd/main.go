@@ -1,28 +1,53 @@
 // Package main contains the executable entry point for the subscriptions service.
 //
-// This package configures a structured JSON logger, creates a context that
-// carries the logger, and starts the HTTP server implemented in the
-// internal/server package. Any fatal error returned by the server is logged
-// and causes the process to exit with a non-zero status code.
+// This package loads the configuration, configures a structured logger with
+// the configured level, format and output, creates a context that carries the
+// logger, and starts the HTTP server implemented in the internal/server
+// package. Any fatal error returned by the server is logged and causes the
+// process to exit with a non-zero status code.
 package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"os"
+	"task_effective_mobile/internal/config"
 	"task_effective_mobile/internal/server"
 	"task_effective_mobile/pkg/logger"
 )
 
-// main configures structured logging and starts the HTTP server.
+// main loads the configuration, configures structured logging and starts the
+// HTTP server.
 //
-// The function constructs a context containing a JSON logger and calls
-// server.Start. If server.Start returns an error, it is logged and the
-// process exits with status code 1.
+// A configuration error is logged with a default JSON logger, since the
+// configured one cannot be built yet. Invalid LOG_LEVEL or LOG_FORMAT values
+// and a LOG_OUTPUT file that cannot be opened are reported as a warning, and
+// the logger falls back to info, JSON and standard output. The log file is
+// closed once the server has stopped. If server.Start returns an error, it is
+// logged and the process exits with status code 1.
 func main() {
-	ctx := logger.WithLogger(context.Background(), slog.New(slog.NewJSONHandler(os.Stdout, nil)))
-	if err := server.Start(ctx); err != nil {
+	os.Exit(run())
+}
+
+// run does the work of main and returns the exit status, so that deferred
+// calls such as closing the log file run before the process exits.
+func run() int {
+	cfg, err := config.New()
+	if err != nil {
+		slog.New(slog.NewJSONHandler(os.Stdout, nil)).Error("failed to load config", "err", err)
+		return 1
+	}
+	out, outErr := logger.OpenOutput(cfg.LogOutput)
+	defer out.Close()
+	log, logErr := logger.New(out, cfg.LogLevel, cfg.LogFormat)
+	if err := errors.Join(outErr, logErr); err != nil {
+		log.Warn("invalid logging configuration", "err", err)
+	}
+	ctx := logger.WithLogger(context.Background(), log)
+	if err := server.Start(ctx, cfg); err != nil {
 		logger.GetLogger(ctx).Error("server exited with error", "err", err)
-		os.Exit(1)
+		return 1
 	}
+	return 0
 }
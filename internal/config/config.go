@@ -1,13 +1,21 @@
 // Package config provides loading of application configuration from environment
 // variables. It uses the cleanenv package to populate a Config struct that
-// contains Postgres connection settings and the server port.
+// contains Postgres connection settings and the server port. For local
+// development the variables may also be kept in a .env file (see New).
 package config
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
 	"task_effective_mobile/pkg/postgres"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/joho/godotenv"
 )
 
 // Config holds application configuration read from environment variables.
@@ -15,19 +23,272 @@ import (
 // Fields are tagged for cleanenv so that environment variables like
 // POSTGRES_HOST, POSTGRES_PORT, POSTGRES_USER, etc. are automatically
 // mapped into the nested Postgres.Config. The Port field is populated from
-// SERVER_PORT.
+// SERVER_PORT (8080 when unset).
 type Config struct {
 	Postgres postgres.Config `env:"POSTGRES"`
-	Port     string          `env:"SERVER_PORT"`
+	Port     string          `env:"SERVER_PORT" env-default:"8080"`
+
+	// MaxInflight caps the number of requests served concurrently; zero
+	// means unlimited.
+	MaxInflight int `env:"MAX_INFLIGHT" env-default:"0"`
+
+	// CreateDefaultStart makes a create request without start_date default
+	// to the current month instead of failing.
+	CreateDefaultStart bool `env:"CREATE_DEFAULT_START" env-default:"false"`
+
+	// DateInputFormats lists extra Go time layouts (comma-separated) that
+	// are accepted for date input in addition to MM-YYYY.
+	DateInputFormats []string `env:"DATE_INPUT_FORMATS" env-separator:","`
+
+	// ExpiryJobInterval is a Go duration such as "10m" setting how often
+	// expired subscriptions are marked; zero disables the job.
+	ExpiryJobInterval time.Duration `env:"EXPIRY_JOB_INTERVAL" env-default:"0"`
+
+	// ValidationStatusCode is the HTTP status (400 or 422) returned for
+	// requests that are well-formed but fail field validation; malformed
+	// JSON is always answered with 400.
+	ValidationStatusCode int `env:"VALIDATION_STATUS_CODE" env-default:"400"`
+
+	// MaxMonths is the largest months value accepted by the analytical
+	// endpoints (such as the trend), bounding response size and query cost.
+	MaxMonths int `env:"MAX_MONTHS" env-default:"60"`
+
+	// DebugSQL adds an X-Debug-SQL response header listing the statements
+	// executed for the request. Development only: it exposes schema details.
+	DebugSQL bool `env:"DEBUG_SQL" env-default:"false"`
+
+	// DebugPoolEnabled serves the connection pool statistics at /debug/pool.
+	DebugPoolEnabled bool `env:"DEBUG_POOL_ENABLED" env-default:"true"`
+
+	// MaintenanceEnabled serves the admin maintenance endpoints, which
+	// rewrite stored rows without authentication. Enable it only for the
+	// duration of a data fix.
+	MaintenanceEnabled bool `env:"MAINTENANCE_ENABLED" env-default:"false"`
+
+	// BillingCycleAnchorDay is the day of month (1-28) on which billing
+	// cycles start, used by the billing_cycle list filter.
+	BillingCycleAnchorDay int `env:"BILLING_CYCLE_ANCHOR_DAY" env-default:"1"`
+
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// after SIGINT/SIGTERM before the server is stopped forcibly.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" env-default:"10s"`
+
+	// HTTPReadTimeout, HTTPWriteTimeout and HTTPIdleTimeout bound how long
+	// the server waits to read a request, to write a response and for the
+	// next request on a keep-alive connection, guarding against slow
+	// clients holding connections open.
+	HTTPReadTimeout  time.Duration `env:"HTTP_READ_TIMEOUT" env-default:"15s"`
+	HTTPWriteTimeout time.Duration `env:"HTTP_WRITE_TIMEOUT" env-default:"15s"`
+	HTTPIdleTimeout  time.Duration `env:"HTTP_IDLE_TIMEOUT" env-default:"60s"`
+
+	// RateLimitRPS is the average number of requests per second allowed
+	// for each client; zero disables rate limiting. RateLimitBurst is the
+	// number of requests a client may send at once above that rate.
+	RateLimitRPS   float64 `env:"RATE_LIMIT_RPS" env-default:"0"`
+	RateLimitBurst int     `env:"RATE_LIMIT_BURST" env-default:"20"`
+
+	// RateLimitTrustForwarded identifies clients by the X-Forwarded-For
+	// header set by a reverse proxy instead of the connection address.
+	RateLimitTrustForwarded bool `env:"RATE_LIMIT_TRUST_FORWARDED" env-default:"false"`
+
+	// CORSAllowedOrigins lists the origins (comma-separated, e.g.
+	// https://app.example.com) whose browser requests are allowed; empty
+	// disables CORS.
+	CORSAllowedOrigins []string `env:"CORS_ALLOWED_ORIGINS" env-separator:","`
+
+	// MaxPrice is the largest subscription price accepted on create and
+	// update; larger prices are rejected as validation errors.
+	MaxPrice int `env:"MAX_PRICE" env-default:"10000000"`
+
+	// MaxBodyBytes is the largest request body, in bytes, accepted by the
+	// endpoints creating or updating subscriptions; larger bodies are
+	// answered with 413.
+	MaxBodyBytes int64 `env:"MAX_BODY_BYTES" env-default:"1048576"`
+
+	// LogLevel (debug, info, warn or error) and LogFormat (json or text)
+	// configure the application logger. Unknown values fall back to info and
+	// json with a warning rather than failing startup.
+	LogLevel  string `env:"LOG_LEVEL" env-default:"info"`
+	LogFormat string `env:"LOG_FORMAT" env-default:"json"`
+
+	// LogOutput is where logs are written: stdout, stderr or the path of a
+	// file that is created or appended to.
+	LogOutput string `env:"LOG_OUTPUT" env-default:"stdout"`
+
+	// TLSCertFile and TLSKeyFile are the PEM certificate (with any
+	// intermediates) and private key files used to serve HTTPS directly.
+	// Both must be set to enable TLS; when neither is, plain HTTP is served.
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+
+	// QueryTimeout bounds each repository call to the database; zero
+	// disables the bound. Calls that time out are answered with 504.
+	QueryTimeout time.Duration `env:"QUERY_TIMEOUT" env-default:"5s"`
 }
 
+// configFileEnv names the environment variable holding the path of the
+// optional .env file read by New.
+const configFileEnv = "CONFIG_FILE"
+
+// defaultConfigFile is the .env file read by New when CONFIG_FILE is unset.
+const defaultConfigFile = ".env"
+
 // New reads configuration from environment variables and returns a populated
-// Config instance. If reading environment variables fails the function
-// returns an error describing the problem.
+// Config instance. If reading environment variables fails or the resulting
+// configuration is invalid (see Validate) the function returns an error
+// describing the problem.
+//
+// When the file named by CONFIG_FILE (".env" in the working directory by
+// default) exists, its variables are loaded into the process environment
+// first, except those already set there: the real environment always takes
+// precedence over the file, so a stray .env cannot override a deployment's
+// settings. A missing file is not an error: the environment alone is read
+// then.
 func New() (*Config, error) {
 	var config Config
+	path := os.Getenv(configFileEnv)
+	if path == "" {
+		path = defaultConfigFile
+	}
+	if _, err := os.Stat(path); err == nil {
+		if err := godotenv.Load(path); err != nil {
+			return nil, fmt.Errorf("New: reading config file %s error: %w", path, err)
+		}
+	}
 	if err := cleanenv.ReadEnv(&config); err != nil {
 		return nil, fmt.Errorf("New: reading env error: %w", err)
 	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("New: invalid config: %w", err)
+	}
 	return &config, nil
 }
+
+// Validate checks that required settings are present and that every value
+// is within its allowed range. It reports all problems at once, joined into
+// a single error, so a misconfigured deployment can be fixed in one pass.
+func (c *Config) Validate() error {
+	var errs []error
+	required := []struct{ name, value string }{
+		{"POSTGRES_HOST", c.Postgres.Host},
+		{"POSTGRES_PORT", c.Postgres.Port},
+		{"POSTGRES_USER", c.Postgres.Username},
+		{"POSTGRES_DB", c.Postgres.Database},
+		{"SERVER_PORT", c.Port},
+	}
+	for _, f := range required {
+		if f.value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", f.name))
+		}
+	}
+	ports := []struct{ name, value string }{
+		{"POSTGRES_PORT", c.Postgres.Port},
+		{"SERVER_PORT", c.Port},
+	}
+	for _, p := range ports {
+		if p.value == "" {
+			continue
+		}
+		if port, err := strconv.Atoi(p.value); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("%s must be a port number between 1 and 65535, got %q", p.name, p.value))
+		}
+	}
+	if !postgres.ValidSSLMode(c.Postgres.SSLMode) {
+		errs = append(errs, fmt.Errorf("POSTGRES_SSLMODE must be one of disable, allow, prefer, require, verify-ca, verify-full, got %q", c.Postgres.SSLMode))
+	}
+	if c.Postgres.MinConns < 0 {
+		errs = append(errs, fmt.Errorf("POSTGRES_MIN_CONNS must not be negative, got %d", c.Postgres.MinConns))
+	}
+	if c.Postgres.MaxConns < c.Postgres.MinConns {
+		errs = append(errs, fmt.Errorf("POSTGRES_MAX_CONNS (%d) must not be less than POSTGRES_MIN_CONNS (%d)", c.Postgres.MaxConns, c.Postgres.MinConns))
+	}
+	if c.Postgres.MaxConnLifetime < 0 {
+		errs = append(errs, fmt.Errorf("POSTGRES_MAX_CONN_LIFETIME must not be negative, got %s", c.Postgres.MaxConnLifetime))
+	}
+	if c.Postgres.HealthCheckPeriod < 0 {
+		errs = append(errs, fmt.Errorf("POSTGRES_HEALTH_CHECK_PERIOD must not be negative, got %s", c.Postgres.HealthCheckPeriod))
+	}
+	if c.Postgres.ConnectRetries < 0 {
+		errs = append(errs, fmt.Errorf("DB_CONNECT_RETRIES must not be negative, got %d", c.Postgres.ConnectRetries))
+	}
+	if c.Postgres.ConnectRetries > 0 && c.Postgres.ConnectRetryDelay <= 0 {
+		errs = append(errs, fmt.Errorf("DB_CONNECT_RETRY_DELAY must be positive, got %s", c.Postgres.ConnectRetryDelay))
+	}
+	if c.ValidationStatusCode != http.StatusBadRequest && c.ValidationStatusCode != http.StatusUnprocessableEntity {
+		errs = append(errs, fmt.Errorf("VALIDATION_STATUS_CODE must be 400 or 422, got %d", c.ValidationStatusCode))
+	}
+	if c.MaxMonths <= 0 {
+		errs = append(errs, fmt.Errorf("MAX_MONTHS must be positive, got %d", c.MaxMonths))
+	}
+	if c.BillingCycleAnchorDay < 1 || c.BillingCycleAnchorDay > 28 {
+		errs = append(errs, fmt.Errorf("BILLING_CYCLE_ANCHOR_DAY must be between 1 and 28, got %d", c.BillingCycleAnchorDay))
+	}
+	timeouts := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"HTTP_READ_TIMEOUT", c.HTTPReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", c.HTTPWriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", c.HTTPIdleTimeout},
+	}
+	for _, t := range timeouts {
+		if t.d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", t.name, t.d))
+		}
+	}
+	if c.QueryTimeout < 0 {
+		errs = append(errs, fmt.Errorf("QUERY_TIMEOUT must not be negative, got %s", c.QueryTimeout))
+	}
+	if c.MaxPrice < 1 || c.MaxPrice > math.MaxInt32 {
+		errs = append(errs, fmt.Errorf("MAX_PRICE must be between 1 and %d, got %d", math.MaxInt32, c.MaxPrice))
+	}
+	if c.MaxBodyBytes <= 0 {
+		errs = append(errs, fmt.Errorf("MAX_BODY_BYTES must be positive, got %d", c.MaxBodyBytes))
+	}
+	if c.RateLimitRPS < 0 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_RPS must not be negative, got %g", c.RateLimitRPS))
+	}
+	if c.RateLimitRPS > 0 && c.RateLimitBurst < 1 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_BURST must be at least 1, got %d", c.RateLimitBurst))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	tlsFiles := []struct{ name, path string }{
+		{"TLS_CERT_FILE", c.TLSCertFile},
+		{"TLS_KEY_FILE", c.TLSKeyFile},
+	}
+	for _, f := range tlsFiles {
+		if f.path == "" {
+			continue
+		}
+		if err := checkReadable(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s must be a readable file: %w", f.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TLSEnabled reports whether the server serves HTTPS, that is whether both
+// TLS_CERT_FILE and TLS_KEY_FILE are set.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// checkReadable reports an error when path cannot be opened for reading or
+// is a directory.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
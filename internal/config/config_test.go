@@ -0,0 +1,226 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"task_effective_mobile/pkg/postgres"
+	"testing"
+	"time"
+)
+
+// validConfig returns a Config that passes Validate, holding the defaults of
+// the env-default tags.
+func validConfig() Config {
+	return Config{
+		Postgres: postgres.Config{
+			Host:              "localhost",
+			Port:              "5432",
+			Username:          "user",
+			Database:          "subscriptions_db",
+			SSLMode:           "disable",
+			MinConns:          2,
+			MaxConns:          10,
+			MaxConnLifetime:   time.Hour,
+			HealthCheckPeriod: time.Minute,
+			ConnectRetries:    5,
+			ConnectRetryDelay: time.Second,
+		},
+		Port:                  "8080",
+		ValidationStatusCode:  400,
+		MaxMonths:             60,
+		BillingCycleAnchorDay: 1,
+		HTTPReadTimeout:       15 * time.Second,
+		HTTPWriteTimeout:      15 * time.Second,
+		HTTPIdleTimeout:       60 * time.Second,
+		RateLimitBurst:        20,
+		MaxPrice:              10000000,
+		MaxBodyBytes:          1048576,
+		QueryTimeout:          5 * time.Second,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := validConfig()
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate() on a valid config = %v, want nil", err)
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(c *Config)
+		wantErr string
+	}{
+		{"missing postgres host", func(c *Config) { c.Postgres.Host = "" }, "POSTGRES_HOST is required"},
+		{"missing postgres port", func(c *Config) { c.Postgres.Port = "" }, "POSTGRES_PORT is required"},
+		{"invalid postgres port", func(c *Config) { c.Postgres.Port = "pg" }, "POSTGRES_PORT must be a port number"},
+		{"postgres port out of range", func(c *Config) { c.Postgres.Port = "70000" }, "POSTGRES_PORT must be a port number"},
+		{"missing postgres user", func(c *Config) { c.Postgres.Username = "" }, "POSTGRES_USER is required"},
+		{"missing postgres db", func(c *Config) { c.Postgres.Database = "" }, "POSTGRES_DB is required"},
+		{"missing server port", func(c *Config) { c.Port = "" }, "SERVER_PORT is required"},
+		{"invalid server port", func(c *Config) { c.Port = "0" }, "SERVER_PORT must be a port number"},
+		{"invalid sslmode", func(c *Config) { c.Postgres.SSLMode = "on" }, "POSTGRES_SSLMODE must be one of"},
+		{"negative min conns", func(c *Config) { c.Postgres.MinConns = -1 }, "POSTGRES_MIN_CONNS must not be negative"},
+		{"max conns below min conns", func(c *Config) { c.Postgres.MaxConns = 1 }, "POSTGRES_MAX_CONNS (1) must not be less than POSTGRES_MIN_CONNS (2)"},
+		{"negative conn lifetime", func(c *Config) { c.Postgres.MaxConnLifetime = -time.Second }, "POSTGRES_MAX_CONN_LIFETIME must not be negative"},
+		{"negative health check period", func(c *Config) { c.Postgres.HealthCheckPeriod = -time.Second }, "POSTGRES_HEALTH_CHECK_PERIOD must not be negative"},
+		{"negative connect retries", func(c *Config) { c.Postgres.ConnectRetries = -1 }, "DB_CONNECT_RETRIES must not be negative"},
+		{"zero connect retry delay", func(c *Config) { c.Postgres.ConnectRetryDelay = 0 }, "DB_CONNECT_RETRY_DELAY must be positive"},
+		{"invalid validation status", func(c *Config) { c.ValidationStatusCode = 500 }, "VALIDATION_STATUS_CODE must be 400 or 422"},
+		{"zero max months", func(c *Config) { c.MaxMonths = 0 }, "MAX_MONTHS must be positive"},
+		{"anchor day too large", func(c *Config) { c.BillingCycleAnchorDay = 29 }, "BILLING_CYCLE_ANCHOR_DAY must be between 1 and 28"},
+		{"zero read timeout", func(c *Config) { c.HTTPReadTimeout = 0 }, "HTTP_READ_TIMEOUT must be positive"},
+		{"zero write timeout", func(c *Config) { c.HTTPWriteTimeout = 0 }, "HTTP_WRITE_TIMEOUT must be positive"},
+		{"zero idle timeout", func(c *Config) { c.HTTPIdleTimeout = 0 }, "HTTP_IDLE_TIMEOUT must be positive"},
+		{"negative query timeout", func(c *Config) { c.QueryTimeout = -time.Second }, "QUERY_TIMEOUT must not be negative"},
+		{"zero max price", func(c *Config) { c.MaxPrice = 0 }, "MAX_PRICE must be between 1 and"},
+		{"zero max body bytes", func(c *Config) { c.MaxBodyBytes = 0 }, "MAX_BODY_BYTES must be positive"},
+		{"negative rate limit", func(c *Config) { c.RateLimitRPS = -1 }, "RATE_LIMIT_RPS must not be negative"},
+		{"zero rate limit burst", func(c *Config) { c.RateLimitRPS, c.RateLimitBurst = 10, 0 }, "RATE_LIMIT_BURST must be at least 1"},
+		{"tls cert without key", func(c *Config) { c.TLSCertFile = os.Args[0] }, "TLS_CERT_FILE and TLS_KEY_FILE must be set together"},
+		{"unreadable tls key", func(c *Config) { c.TLSKeyFile = "/nonexistent/key.pem" }, "TLS_KEY_FILE must be a readable file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.mutate(&c)
+			err := c.Validate()
+			if err == nil {
+				t.Fatalf("Validate() = nil, want error containing %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateJoinsAllErrors(t *testing.T) {
+	c := validConfig()
+	c.Postgres.Host = ""
+	c.Port = "http"
+	c.MaxMonths = -1
+	c.MaxBodyBytes = 0
+
+	err := c.Validate()
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("Validate() = %v, want an errors.Join error", err)
+	}
+	errs := joined.Unwrap()
+	want := []string{
+		"POSTGRES_HOST is required",
+		"SERVER_PORT must be a port number",
+		"MAX_MONTHS must be positive",
+		"MAX_BODY_BYTES must be positive",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Validate() returned %d errors, want %d: %v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		if !strings.Contains(errs[i].Error(), w) {
+			t.Errorf("error %d = %q, want it to contain %q", i, errs[i], w)
+		}
+	}
+}
+
+// setRequiredEnv sets the variables New requires and points CONFIG_FILE at
+// a missing file, so that only the process environment is read.
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv(configFileEnv, t.TempDir()+"/missing.env")
+	t.Setenv("POSTGRES_HOST", "localhost")
+	t.Setenv("POSTGRES_PORT", "5432")
+	t.Setenv("POSTGRES_USER", "user")
+	t.Setenv("POSTGRES_DB", "subscriptions_db")
+	t.Setenv("SERVER_PORT", "8080")
+}
+
+// unsetEnv removes the named variables for the duration of the test.
+func unsetEnv(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func TestHTTPTimeouts(t *testing.T) {
+	names := []string{"HTTP_READ_TIMEOUT", "HTTP_WRITE_TIMEOUT", "HTTP_IDLE_TIMEOUT"}
+	tests := []struct {
+		name              string
+		env               map[string]string
+		read, write, idle time.Duration
+	}{
+		{"defaults", nil, 15 * time.Second, 15 * time.Second, 60 * time.Second},
+		{"overrides", map[string]string{
+			"HTTP_READ_TIMEOUT":  "5s",
+			"HTTP_WRITE_TIMEOUT": "1m30s",
+			"HTTP_IDLE_TIMEOUT":  "2m",
+		}, 5 * time.Second, 90 * time.Second, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			unsetEnv(t, names...)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := New()
+			if err != nil {
+				t.Fatalf("New() error: %v", err)
+			}
+			if cfg.HTTPReadTimeout != tt.read || cfg.HTTPWriteTimeout != tt.write || cfg.HTTPIdleTimeout != tt.idle {
+				t.Errorf("timeouts = %s, %s, %s, want %s, %s, %s",
+					cfg.HTTPReadTimeout, cfg.HTTPWriteTimeout, cfg.HTTPIdleTimeout, tt.read, tt.write, tt.idle)
+			}
+		})
+	}
+}
+
+func TestHTTPTimeoutInvalidDuration(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("HTTP_READ_TIMEOUT", "15")
+	if _, err := New(); err == nil {
+		t.Fatal("New() with HTTP_READ_TIMEOUT=15 = nil error, want a parse error")
+	}
+}
+
+func TestNewReadsConfigFile(t *testing.T) {
+	setRequiredEnv(t)
+	unsetEnv(t, "SERVER_PORT", "MAX_MONTHS")
+	path := t.TempDir() + "/test.env"
+	if err := os.WriteFile(path, []byte("SERVER_PORT=9090\nMAX_MONTHS=12\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configFileEnv, path)
+
+	cfg, err := New()
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if cfg.Port != "9090" || cfg.MaxMonths != 12 {
+		t.Errorf("Port, MaxMonths = %q, %d, want the file values %q, %d", cfg.Port, cfg.MaxMonths, "9090", 12)
+	}
+}
+
+func TestNewEnvironmentOverridesConfigFile(t *testing.T) {
+	setRequiredEnv(t)
+	unsetEnv(t, "MAX_MONTHS")
+	t.Setenv("SERVER_PORT", "8081")
+	path := t.TempDir() + "/test.env"
+	if err := os.WriteFile(path, []byte("SERVER_PORT=9090\nMAX_MONTHS=12\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configFileEnv, path)
+
+	cfg, err := New()
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if cfg.Port != "8081" {
+		t.Errorf("Port = %q, want the environment value %q over the file", cfg.Port, "8081")
+	}
+	if cfg.MaxMonths != 12 {
+		t.Errorf("MaxMonths = %d, want the file value 12 for a variable not in the environment", cfg.MaxMonths)
+	}
+}
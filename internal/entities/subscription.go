@@ -4,19 +4,74 @@
 // repositories and transported via HTTP handlers.
 package entities
 
+import "time"
+
 // Subscription represents a user's subscription to a service.
 //
 // ID is the database identifier. ServiceName is the name of the subscribed
 // service (for example "netflix"). Price is an integer amount (in cents or
-// the minimal currency unit as used by your application). UserID references
-// the owner of the subscription. StartDate and EndDate are formatted as
-// "MM-YYYY" when exposed via the API; EndDate may be empty to indicate an
-// open-ended subscription.
+// the minimal currency unit as used by your application) in Currency, an ISO
+// 4217 code such as "USD". UserID references the owner of the subscription.
+// StartDate and EndDate are formatted as "MM-YYYY" when exposed via the API;
+// EndDate may be empty to indicate an open-ended subscription. Status is
+// "active" or "expired" and is kept up to date by a background job rather
+// than computed on every read. ExternalID is the optional identifier of the
+// subscription in an external billing system and is empty when not set.
+// HasDuplicate is only set when a listing was asked to annotate duplicates
+// and reports whether another subscription of the same user to the same
+// (case-insensitive) service overlaps this one. CreatedAt and UpdatedAt
+// record when the row was inserted and last modified through the API; they
+// are serialized as RFC 3339 timestamps. Version starts at 1 and is
+// incremented on every change; updates must name the version they are based
+// on, so that concurrent modifications are detected. The expiry job does not
+// increment it when it flips Status, which only follows EndDate.
+//
+// The JSON names match the snake_case fields of the create and update
+// requests. EndDate and ExternalID are omitted when empty.
 type Subscription struct {
-	ID          int
-	ServiceName string
-	Price       int
-	UserID      string
-	StartDate   string
-	EndDate     string
+	ID           int       `json:"id"`
+	ServiceName  string    `json:"service_name"`
+	Price        int       `json:"price"`
+	Currency     string    `json:"currency"`
+	UserID       string    `json:"user_id"`
+	StartDate    string    `json:"start_date"`
+	EndDate      string    `json:"end_date,omitempty"`
+	Status       string    `json:"status"`
+	ExternalID   string    `json:"external_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Version      int       `json:"version"`
+	HasDuplicate *bool     `json:"has_duplicate,omitempty"`
+}
+
+// ISOPeriod returns the subscription interval as an ISO 8601 time interval
+// with month precision, for example "2024-01/2024-12", or "2024-01/" for an
+// open-ended subscription. An empty string is returned when StartDate is not
+// a valid "MM-YYYY" value.
+func (s Subscription) ISOPeriod() string {
+	start, err := time.Parse("01-2006", s.StartDate)
+	if err != nil {
+		return ""
+	}
+	period := start.Format("2006-01") + "/"
+	if end, err := time.Parse("01-2006", s.EndDate); err == nil {
+		period += end.Format("2006-01")
+	}
+	return period
+}
+
+// MonthsRemaining returns the number of months from now until EndDate, or nil
+// for an open-ended subscription (or one whose EndDate is not a valid
+// "MM-YYYY" value). A subscription ending in the current month has 0 months
+// remaining, and so does one that has already ended.
+func (s Subscription) MonthsRemaining(now time.Time) *int {
+	end, err := time.Parse("01-2006", s.EndDate)
+	if err != nil {
+		return nil
+	}
+	months := (end.Year()-now.Year())*12 + int(end.Month()) - int(now.Month())
+	if months < 0 {
+		months = 0
+	}
+	return &months
 }
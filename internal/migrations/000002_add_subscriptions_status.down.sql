@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS subscriptions_status_idx;
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS status;
\ No newline at end of file
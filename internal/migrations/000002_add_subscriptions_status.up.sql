@@ -0,0 +1,5 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active';
+
+UPDATE subscriptions SET status = 'expired' WHERE end_date < date_trunc('month', now())::date;
+
+CREATE INDEX IF NOT EXISTS subscriptions_status_idx ON subscriptions (status);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS external_id;
\ No newline at end of file
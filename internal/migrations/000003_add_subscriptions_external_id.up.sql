@@ -0,0 +1 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS external_id VARCHAR(255) UNIQUE;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE subscriptions ALTER COLUMN created_at DROP NOT NULL;
\ No newline at end of file
@@ -0,0 +1,4 @@
+UPDATE subscriptions SET created_at = CURRENT_TIMESTAMP WHERE created_at IS NULL;
+ALTER TABLE subscriptions ALTER COLUMN created_at SET NOT NULL;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP;
+UPDATE subscriptions SET updated_at = created_at;
\ No newline at end of file
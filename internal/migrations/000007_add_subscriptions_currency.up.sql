@@ -0,0 +1 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_period_check CHECK (end_date IS NULL OR end_date >= start_date);
\ No newline at end of file
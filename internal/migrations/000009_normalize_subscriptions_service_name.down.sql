@@ -0,0 +1 @@
+-- The original casing of service names is not kept, so the normalization cannot be undone.
\ No newline at end of file
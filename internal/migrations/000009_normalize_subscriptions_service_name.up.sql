@@ -0,0 +1 @@
+UPDATE subscriptions SET service_name = lower(btrim(service_name)) WHERE service_name <> lower(btrim(service_name));
\ No newline at end of file
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS subscriptions_user_id_idx;
\ No newline at end of file
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS subscriptions_user_id_idx ON subscriptions (user_id, id) WHERE deleted_at IS NULL;
\ No newline at end of file
@@ -0,0 +1,104 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// sqlRecorderKey is the context key under which a SQLRecorder is stored.
+type sqlRecorderKey struct{}
+
+// SQLRecorder collects the statements a repository executed on behalf of a
+// single request. It is only populated when the repository was created with
+// Options.DebugSQL and is meant for development diagnostics.
+type SQLRecorder struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+// WithSQLRecorder returns a copy of ctx carrying a new SQLRecorder along with
+// the recorder itself. Statements executed with the returned context are
+// appended to the recorder.
+func WithSQLRecorder(ctx context.Context) (context.Context, *SQLRecorder) {
+	rec := &SQLRecorder{}
+	return context.WithValue(ctx, sqlRecorderKey{}, rec), rec
+}
+
+// String returns the recorded statements in execution order, each with
+// whitespace collapsed to single spaces and followed by its argument count,
+// separated by "; ".
+func (rec *SQLRecorder) String() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return strings.Join(rec.entries, "; ")
+}
+
+// recordSQL appends sql to the recorder stored in ctx, if any.
+func recordSQL(ctx context.Context, sql string, args int) {
+	rec, ok := ctx.Value(sqlRecorderKey{}).(*SQLRecorder)
+	if !ok {
+		return
+	}
+	entry := fmt.Sprintf("%s [args=%d]", strings.Join(strings.Fields(sql), " "), args)
+	rec.mu.Lock()
+	rec.entries = append(rec.entries, entry)
+	rec.mu.Unlock()
+}
+
+// recordingQuerier wraps a querier and records every statement into the
+// SQLRecorder of the call's context. Transactions started through it are
+// wrapped as well.
+type recordingQuerier struct {
+	q querier
+}
+
+func (d recordingQuerier) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := d.q.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return recordingTx{Tx: tx, rq: recordingQuerier{q: tx}}, nil
+}
+
+func (d recordingQuerier) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	recordSQL(ctx, sql, len(args))
+	return d.q.Exec(ctx, sql, args...)
+}
+
+func (d recordingQuerier) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	recordSQL(ctx, sql, len(args))
+	return d.q.Query(ctx, sql, args...)
+}
+
+func (d recordingQuerier) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	recordSQL(ctx, sql, len(args))
+	return d.q.QueryRow(ctx, sql, args...)
+}
+
+// recordingTx is a pgx.Tx whose statements are recorded like those of
+// recordingQuerier.
+type recordingTx struct {
+	pgx.Tx
+	rq recordingQuerier
+}
+
+func (t recordingTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return t.rq.Begin(ctx)
+}
+
+func (t recordingTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return t.rq.Exec(ctx, sql, args...)
+}
+
+func (t recordingTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return t.rq.Query(ctx, sql, args...)
+}
+
+func (t recordingTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return t.rq.QueryRow(ctx, sql, args...)
+}
@@ -0,0 +1,55 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error classes of the repository. Errors returned by SubscriptionsRepository
+// methods match at most one of them with errors.Is, which lets callers choose
+// a response without inspecting the message. The message itself is not
+// changed by the classification and can be shown to clients as is.
+var (
+	// ErrNotFound is matched when the requested subscription does not exist
+	// or has been deleted.
+	ErrNotFound = errors.New("not found")
+	// ErrValidation is matched when the input is invalid, including every
+	// *FieldError.
+	ErrValidation = errors.New("invalid input")
+	// ErrConflict is matched when a write conflicts with stored data, such
+	// as an overlapping subscription or a duplicate external_id.
+	ErrConflict = errors.New("conflict")
+	// ErrIdempotencyKeyReused is matched when an idempotency key is replayed
+	// with a different request.
+	ErrIdempotencyKeyReused = errors.New("idempotency key reused")
+)
+
+// classifiedError attaches one of the error classes above to err without
+// altering its message.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+// notFoundf formats an error matching ErrNotFound.
+func notFoundf(format string, args ...any) error {
+	return &classifiedError{class: ErrNotFound, err: fmt.Errorf(format, args...)}
+}
+
+// invalidf formats an error matching ErrValidation.
+func invalidf(format string, args ...any) error {
+	return &classifiedError{class: ErrValidation, err: fmt.Errorf(format, args...)}
+}
+
+// conflictf formats an error matching ErrConflict.
+func conflictf(format string, args ...any) error {
+	return &classifiedError{class: ErrConflict, err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,82 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// IdempotencyKeyTTL is how long a recorded idempotency key is honored. An
+// expired key is treated as unused.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotentResponse is the response recorded for an idempotency key.
+type IdempotentResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+// RunIdempotent runs fn at most once per idempotency key. On first use of key
+// fn is called with a repository bound to a transaction, and its response is
+// recorded under key in that same transaction, so the work and the record
+// commit or roll back together. On a later call with the same key and
+// requestHash the recorded response is returned with replayed set and fn is
+// not called; a different requestHash yields an error matching
+// ErrIdempotencyKeyReused. Concurrent calls with
+// the same key are serialized by the database. Keys expire after
+// IdempotencyKeyTTL.
+func (r *SubscriptionsRepository) RunIdempotent(ctx context.Context, key string, requestHash string, fn func(repo *SubscriptionsRepository) (IdempotentResponse, error)) (IdempotentResponse, bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return IdempotentResponse{}, false, fmt.Errorf("RunIdempotent: failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	expiredQuery := `DELETE FROM idempotency_keys WHERE created_at < now() - make_interval(secs => $1)`
+	if _, err := tx.Exec(ctx, expiredQuery, IdempotencyKeyTTL.Seconds()); err != nil {
+		return IdempotentResponse{}, false, fmt.Errorf("RunIdempotent: failed to delete expired keys: %w", err)
+	}
+
+	claimQuery := `INSERT INTO idempotency_keys (key, request_hash) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`
+	cmdTag, err := tx.Exec(ctx, claimQuery, key, requestHash)
+	if err != nil {
+		return IdempotentResponse{}, false, fmt.Errorf("RunIdempotent: failed to record key: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return r.replayIdempotent(ctx, tx, key, requestHash)
+	}
+
+	resp, err := fn(r.onTx(tx))
+	if err != nil {
+		return IdempotentResponse{}, false, err
+	}
+
+	saveQuery := `UPDATE idempotency_keys SET status_code = $2, response = $3 WHERE key = $1`
+	if _, err := tx.Exec(ctx, saveQuery, key, resp.StatusCode, resp.Body); err != nil {
+		return IdempotentResponse{}, false, fmt.Errorf("RunIdempotent: failed to save response: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return IdempotentResponse{}, false, fmt.Errorf("RunIdempotent: failed to commit transaction: %w", err)
+	}
+	return resp, false, nil
+}
+
+// replayIdempotent returns the response recorded for key, provided it was
+// recorded for the same request.
+func (r *SubscriptionsRepository) replayIdempotent(ctx context.Context, tx pgx.Tx, key string, requestHash string) (IdempotentResponse, bool, error) {
+	var storedHash string
+	var resp IdempotentResponse
+	query := `SELECT request_hash, status_code, response FROM idempotency_keys WHERE key = $1`
+	if err := tx.QueryRow(ctx, query, key).Scan(&storedHash, &resp.StatusCode, &resp.Body); err != nil {
+		return IdempotentResponse{}, false, fmt.Errorf("RunIdempotent: failed to read recorded response: %w", err)
+	}
+	if storedHash != requestHash {
+		reused := &classifiedError{class: ErrIdempotencyKeyReused, err: fmt.Errorf("idempotency key %q was already used with a different request", key)}
+		return IdempotentResponse{}, false, fmt.Errorf("RunIdempotent: %w", reused)
+	}
+	return resp, true, nil
+}
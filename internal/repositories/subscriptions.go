@@ -7,278 +7,2042 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"task_effective_mobile/internal/entities"
 	"task_effective_mobile/pkg/postgres"
 	"time"
 
 	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// querier is the set of query methods shared by *pgxpool.Pool and pgx.Tx,
+// letting the same query code run on the pool or inside a transaction.
+// Begin on a pgx.Tx starts a savepoint, so methods that need their own
+// transaction still work when the repository is bound to an outer one.
+type querier interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 // SubscriptionsRepository implements persistence operations for subscriptions
 // using a pgx connection pool. Create an instance with NewSubscriptionsRepository
 // and use the methods to create, read, update, delete, list and aggregate
-// subscription records.
+// subscription records. Use WithTx to run the same methods inside a
+// caller-managed transaction.
 type SubscriptionsRepository struct {
-	pg *pgxpool.Pool
+	pool        *pgxpool.Pool
+	db          querier
+	dateLayouts []string
+	debugSQL    bool
+	// queryTimeout bounds each repository method call; zero means no bound.
+	queryTimeout time.Duration
+	// maxPrice is the largest price accepted on write; zero means only the
+	// column range applies.
+	maxPrice int
+}
+
+// monthLayout is the canonical "MM-YYYY" layout used for dates exchanged
+// with clients and always accepted on input.
+const monthLayout = "01-2006"
+
+// Options holds repository behavior that is independent of the database
+// connection.
+//
+// DateLayouts lists additional time layouts (for example "2006-01" or
+// "01/2006") accepted for date input. They are tried in order after the
+// canonical MM-YYYY layout; parsed values are always stored as the first
+// day of their month.
+//
+// DebugSQL makes the repository record every executed statement into the
+// SQLRecorder carried by the call's context (see WithSQLRecorder). It is a
+// development aid and must stay off in production.
+//
+// QueryTimeout bounds how long a single repository method may wait on the
+// database; zero disables the bound. A method that runs out of time returns
+// an error wrapping context.DeadlineExceeded.
+//
+// MaxPrice is the largest price accepted when creating or updating a
+// subscription, catching fat-fingered amounts; zero leaves only the range
+// of the price column.
+type Options struct {
+	DateLayouts  []string
+	DebugSQL     bool
+	QueryTimeout time.Duration
+	MaxPrice     int
+}
+
+// NewSubscriptionsRepository creates a new SubscriptionsRepository connected
+// to the Postgres database described by cfg and configured with opts. The
+// service parameter is used only for logging/migration context inside the
+// postgres package.
+func NewSubscriptionsRepository(ctx context.Context, cfg postgres.Config, opts Options) (*SubscriptionsRepository, error) {
+	pool, err := postgres.New(ctx, cfg, "subscriptions_db")
+	if err != nil {
+		return nil, fmt.Errorf("NewSubscriptionsRepository: failed to connect to postgres: %w", err)
+	}
+	return newSubscriptionsRepository(pool, opts), nil
+}
+
+// newSubscriptionsRepository returns a repository using pool, configured
+// with opts.
+func newSubscriptionsRepository(pool *pgxpool.Pool, opts Options) *SubscriptionsRepository {
+	layouts := []string{monthLayout}
+	for _, layout := range opts.DateLayouts {
+		if layout = strings.TrimSpace(layout); layout != "" && layout != monthLayout {
+			layouts = append(layouts, layout)
+		}
+	}
+	r := &SubscriptionsRepository{pool: pool, dateLayouts: layouts, debugSQL: opts.DebugSQL, queryTimeout: opts.QueryTimeout, maxPrice: opts.MaxPrice}
+	r.db = r.bind(pool)
+	return r
+}
+
+// Close closes the underlying connection pool, waiting for acquired
+// connections to be released. It is a no-op for a repository returned by
+// WithTx, whose transaction belongs to the caller.
+func (r *SubscriptionsRepository) Close() {
+	if r.pool != nil {
+		r.pool.Close()
+	}
+}
+
+// PoolStats is a snapshot of the connection pool of a repository.
+// AcquireCount is the total number of connections acquired so far and
+// AcquireDurationSeconds the total time spent waiting for them, so their
+// ratio is the average acquire wait.
+type PoolStats struct {
+	AcquiredConns          int32   `json:"acquired_conns"`
+	IdleConns              int32   `json:"idle_conns"`
+	TotalConns             int32   `json:"total_conns"`
+	MaxConns               int32   `json:"max_conns"`
+	AcquireCount           int64   `json:"acquire_count"`
+	AcquireDurationSeconds float64 `json:"acquire_duration_seconds"`
+}
+
+// PoolStats returns the current connection pool statistics. A repository
+// returned by WithTx has no pool and reports zeros.
+func (r *SubscriptionsRepository) PoolStats() *PoolStats {
+	if r.pool == nil {
+		return &PoolStats{}
+	}
+	stat := r.pool.Stat()
+	return &PoolStats{
+		AcquiredConns: stat.AcquiredConns(),
+		IdleConns:     stat.IdleConns(),
+		TotalConns:    stat.TotalConns(),
+		MaxConns:      stat.MaxConns(),
+
+		AcquireCount:           stat.AcquireCount(),
+		AcquireDurationSeconds: stat.AcquireDuration().Seconds(),
+	}
+}
+
+// undefinedTableCode is the Postgres SQLSTATE reported when a query names a
+// table that does not exist.
+const undefinedTableCode = "42P01"
+
+// MigrationVersion returns the version of the last migration applied to the
+// database and whether it failed halfway, as recorded by golang-migrate in
+// the schema_migrations table. Migrations are numbered from 1 without gaps,
+// so the version is also the number of applied migrations. A not-found error
+// is returned when no migration has been applied.
+func (r *SubscriptionsRepository) MigrationVersion(ctx context.Context) (int, bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	var version int
+	var dirty bool
+	err := r.db.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	var pgErr *pgconn.PgError
+	if errors.Is(err, pgx.ErrNoRows) || (errors.As(err, &pgErr) && pgErr.Code == undefinedTableCode) {
+		return 0, false, fmt.Errorf("MigrationVersion: %w", notFoundf("no migrations have been applied"))
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("MigrationVersion: failed to query schema_migrations: %w", err)
+	}
+	return version, dirty, nil
+}
+
+// withTimeout derives the context of a repository method call from ctx,
+// bounded by the configured query timeout when there is one. The returned
+// cancel function must be called when the call returns.
+func (r *SubscriptionsRepository) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.queryTimeout)
+}
+
+// bind returns q wrapped for statement recording when DebugSQL is enabled.
+func (r *SubscriptionsRepository) bind(q querier) querier {
+	if r.debugSQL {
+		return recordingQuerier{q: q}
+	}
+	return q
+}
+
+// WithTx returns a copy of the repository whose methods run on tx instead of
+// the pool. The caller owns tx and is responsible for committing or rolling
+// it back; the returned repository must not be used after that.
+func (r *SubscriptionsRepository) WithTx(tx pgx.Tx) *SubscriptionsRepository {
+	return &SubscriptionsRepository{db: r.bind(tx), dateLayouts: r.dateLayouts, debugSQL: r.debugSQL, queryTimeout: r.queryTimeout, maxPrice: r.maxPrice}
+}
+
+// onTx returns a copy of the repository running on tx, a transaction begun
+// on r.db by the repository itself and therefore already bound.
+func (r *SubscriptionsRepository) onTx(tx pgx.Tx) *SubscriptionsRepository {
+	return &SubscriptionsRepository{db: tx, dateLayouts: r.dateLayouts, debugSQL: r.debugSQL, queryTimeout: r.queryTimeout, maxPrice: r.maxPrice}
+}
+
+// parseMonth parses value with each accepted date layout in order and
+// returns the first day of the parsed month. When no layout matches the
+// error lists the accepted formats.
+func (r *SubscriptionsRepository) parseMonth(value string) (time.Time, error) {
+	for _, layout := range r.dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+	formats := make([]string, 0, len(r.dateLayouts))
+	for _, layout := range r.dateLayouts {
+		formats = append(formats, layoutFormatNames.Replace(layout))
+	}
+	return time.Time{}, fmt.Errorf("%q does not match any accepted format (%s)", value, strings.Join(formats, ", "))
+}
+
+// ParseMonth parses value like the start and end dates given to CreateSub
+// and UpdateSub (see parseMonth), so that handlers accept the same formats in
+// other month parameters.
+func (r *SubscriptionsRepository) ParseMonth(value string) (time.Time, error) {
+	return r.parseMonth(value)
+}
+
+// layoutFormatNames turns Go reference-time layouts into the human readable
+// notation used in error messages, e.g. "01-2006" into "MM-YYYY".
+var layoutFormatNames = strings.NewReplacer("2006", "YYYY", "01", "MM", "02", "DD")
+
+// CreateSub inserts a new subscription record and returns the created id.
+//
+// serviceName is stored normalized (see NormalizeServiceName). startDate and
+// endDate must be formatted as "MM-YYYY". endDate is optional and may be an
+// empty string to represent an open-ended subscription. Price must be
+// non-negative. currency is the ISO 4217 code of the price (see
+// parseCurrency); an empty string means DefaultCurrency. externalID is the
+// optional identifier of the subscription in an external billing system; it
+// must be unique and an empty string stores no identifier. The subscription
+// must not overlap another one of the same user to the same service (see
+// checkOverlap); the check and the insert run in one transaction.
+func (r *SubscriptionsRepository) CreateSub(ctx context.Context, serviceName string, price int, currency string, userId string, startDate string, endDate string, externalID string) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	serviceName = NormalizeServiceName(serviceName)
+	start, end, err := r.parseNewSub(price, startDate, endDate)
+	if err != nil {
+		return 0, fmt.Errorf("CreateSub: %w", err)
+	}
+	if currency, err = parseCurrency(currency); err != nil {
+		return 0, fmt.Errorf("CreateSub: %w", err)
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("CreateSub: failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err := lockUserService(ctx, tx, userId, serviceName); err != nil {
+		return 0, fmt.Errorf("CreateSub: %w", err)
+	}
+	if err := checkOverlap(ctx, tx, userId, serviceName, start, end, nil, ""); err != nil {
+		return 0, fmt.Errorf("CreateSub: %w", err)
+	}
+
+	var id int
+	row := tx.QueryRow(ctx, insertSubQuery, serviceName, price, currency, userId, start, end, externalID)
+	if err := row.Scan(&id); err != nil {
+		if isUniqueViolation(err) {
+			return 0, fmt.Errorf("CreateSub: %w", conflictf("subscription with external_id %q already exists", externalID))
+		}
+		if isNumericOverflow(err) {
+			return 0, fmt.Errorf("CreateSub: %w", errPriceOverflow)
+		}
+		if isPeriodViolation(err) {
+			return 0, fmt.Errorf("CreateSub: %w", invertedPeriodError())
+		}
+		return 0, fmt.Errorf("CreateSub: failed to insert subscription: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("CreateSub: failed to commit transaction: %w", err)
+	}
+	return id, nil
+}
+
+// upsertByExternalIDQuery inserts a subscription or, when one with the same
+// external_id exists, overwrites its fields. xmax is 0 only for a freshly
+// inserted row version, which tells the two cases apart.
+const upsertByExternalIDQuery = `INSERT INTO subscriptions (service_name, price, currency, user_id, start_date, end_date, external_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (external_id) DO UPDATE SET
+		service_name = EXCLUDED.service_name,
+		price = EXCLUDED.price,
+		currency = EXCLUDED.currency,
+		user_id = EXCLUDED.user_id,
+		start_date = EXCLUDED.start_date,
+		end_date = EXCLUDED.end_date,
+		updated_at = now(),
+		deleted_at = NULL,
+		version = subscriptions.version + 1
+	RETURNING id, (xmax = 0) AS created`
+
+// UpsertByExternalID atomically creates the subscription identified by
+// externalID or replaces the fields of the existing one, restoring it if it
+// was soft-deleted. Arguments follow CreateSub, except that externalID is
+// required; the existing subscription with externalID does not count as
+// overlapping. Like CreateSub, the overlap check and the write run in one
+// transaction under the lock of the user and service. It returns the
+// subscription id and whether a new row was created.
+func (r *SubscriptionsRepository) UpsertByExternalID(ctx context.Context, externalID string, serviceName string, price int, currency string, userId string, startDate string, endDate string) (int, bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if externalID == "" {
+		return 0, false, fmt.Errorf("UpsertByExternalID: %w", invalidf("externalID cannot be empty"))
+	}
+	serviceName = NormalizeServiceName(serviceName)
+	start, end, err := r.parseNewSub(price, startDate, endDate)
+	if err != nil {
+		return 0, false, fmt.Errorf("UpsertByExternalID: %w", err)
+	}
+	if currency, err = parseCurrency(currency); err != nil {
+		return 0, false, fmt.Errorf("UpsertByExternalID: %w", err)
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("UpsertByExternalID: failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// An existing subscription may move to another user or service, so the
+	// locks of both pairs are taken, as UpdateSub does.
+	keys := [][2]string{{userId, serviceName}}
+	var storedUser, storedService string
+	err = tx.QueryRow(ctx, `SELECT user_id, service_name FROM subscriptions WHERE external_id = $1`, externalID).Scan(&storedUser, &storedService)
+	if err == nil {
+		keys = append(keys, [2]string{storedUser, storedService})
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, fmt.Errorf("UpsertByExternalID: failed to load subscription: %w", err)
+	}
+	if err := lockUserServices(ctx, tx, keys...); err != nil {
+		return 0, false, fmt.Errorf("UpsertByExternalID: %w", err)
+	}
+	if err := checkOverlap(ctx, tx, userId, serviceName, start, end, nil, externalID); err != nil {
+		return 0, false, fmt.Errorf("UpsertByExternalID: %w", err)
+	}
+
+	var id int
+	var created bool
+	row := tx.QueryRow(ctx, upsertByExternalIDQuery, serviceName, price, currency, userId, start, end, externalID)
+	if err := row.Scan(&id, &created); err != nil {
+		if isNumericOverflow(err) {
+			return 0, false, fmt.Errorf("UpsertByExternalID: %w", errPriceOverflow)
+		}
+		if isPeriodViolation(err) {
+			return 0, false, fmt.Errorf("UpsertByExternalID: %w", invertedPeriodError())
+		}
+		return 0, false, fmt.Errorf("UpsertByExternalID: failed to upsert subscription: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, false, fmt.Errorf("UpsertByExternalID: failed to commit transaction: %w", err)
+	}
+	return id, created, nil
+}
+
+// CreateSubClosingPrevious inserts a new subscription like CreateSub and, in
+// the same transaction, closes the user's subscriptions to the same service
+// that are still active at the new start date by setting their end_date to
+// the new start date. It returns the created id and the number of closed
+// subscriptions. This models moving a user to a new plan of a service. The
+// closed subscriptions end in the new start month and are not counted as
+// overlapping the new one.
+func (r *SubscriptionsRepository) CreateSubClosingPrevious(ctx context.Context, serviceName string, price int, currency string, userId string, startDate string, endDate string, externalID string) (int, int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	serviceName = NormalizeServiceName(serviceName)
+	start, end, err := r.parseNewSub(price, startDate, endDate)
+	if err != nil {
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: %w", err)
+	}
+	if currency, err = parseCurrency(currency); err != nil {
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: %w", err)
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err := lockUserService(ctx, tx, userId, serviceName); err != nil {
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: %w", err)
+	}
+	closeQuery := `UPDATE subscriptions SET end_date = $3, updated_at = now(), version = version + 1
+		WHERE user_id = $1 AND service_name = $2 AND deleted_at IS NULL
+			AND start_date <= $3 AND (end_date IS NULL OR end_date >= $3)
+		RETURNING id`
+	rows, err := tx.Query(ctx, closeQuery, userId, serviceName, start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: failed to close previous subscriptions: %w", err)
+	}
+	closedIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: failed to close previous subscriptions: %w", err)
+	}
+	if err := checkOverlap(ctx, tx, userId, serviceName, start, end, closedIDs, ""); err != nil {
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: %w", err)
+	}
+
+	var id int
+	row := tx.QueryRow(ctx, insertSubQuery, serviceName, price, currency, userId, start, end, externalID)
+	if err := row.Scan(&id); err != nil {
+		if isUniqueViolation(err) {
+			return 0, 0, fmt.Errorf("CreateSubClosingPrevious: %w", conflictf("subscription with external_id %q already exists", externalID))
+		}
+		if isNumericOverflow(err) {
+			return 0, 0, fmt.Errorf("CreateSubClosingPrevious: %w", errPriceOverflow)
+		}
+		if isPeriodViolation(err) {
+			return 0, 0, fmt.Errorf("CreateSubClosingPrevious: %w", invertedPeriodError())
+		}
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: failed to insert subscription: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, fmt.Errorf("CreateSubClosingPrevious: failed to commit transaction: %w", err)
+	}
+	return id, len(closedIDs), nil
+}
+
+// NewSub holds the fields of a subscription to create, as accepted by
+// CreateSub.
+type NewSub struct {
+	ServiceName string
+	Price       int
+	Currency    string
+	UserID      string
+	StartDate   string
+	EndDate     string
+	ExternalID  string
+}
+
+// BatchItemError reports the failure of one element of a batch, identified
+// by its index in the input.
+type BatchItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchItemError) Error() string {
+	return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
+
+// CreateSubsBatch inserts subs in a single transaction, applying the same
+// rules as CreateSub to each of them, and returns the created ids in input
+// order. Subscriptions earlier in the batch count for the overlap check of
+// later ones. If any element fails nothing is inserted and the returned
+// error wraps a *BatchItemError naming the element. The query timeout
+// applies to each element rather than to the whole batch.
+func (r *SubscriptionsRepository) CreateSubsBatch(ctx context.Context, subs []NewSub) ([]int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("CreateSubsBatch: failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	txRepo := r.onTx(tx)
+	ids := make([]int, 0, len(subs))
+	for i, s := range subs {
+		id, err := txRepo.CreateSub(ctx, s.ServiceName, s.Price, s.Currency, s.UserID, s.StartDate, s.EndDate, s.ExternalID)
+		if err != nil {
+			return nil, fmt.Errorf("CreateSubsBatch: %w", &BatchItemError{Index: i, Err: err})
+		}
+		ids = append(ids, id)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("CreateSubsBatch: failed to commit transaction: %w", err)
+	}
+	return ids, nil
+}
+
+// NormalizeServiceName returns the canonical form of a service name: trimmed
+// and lowercased. Service names are stored in this form, and filters on them
+// are normalized the same way, so "Netflix", " netflix" and "NETFLIX" are one
+// service in listings and reports.
+func NormalizeServiceName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// insertSubQuery inserts a subscription and returns its id. An empty
+// external id is stored as NULL.
+const insertSubQuery = `INSERT INTO subscriptions (service_name, price, currency, user_id, start_date, end_date, external_id) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')) RETURNING id`
+
+// uniqueViolationCode is the Postgres SQLSTATE reported when a unique
+// constraint (such as the one on external_id) is violated.
+const uniqueViolationCode = "23505"
+
+// isUniqueViolation reports whether err was caused by a unique constraint
+// violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
+// externalIDConstraint is the unique constraint on external_id, named by
+// Postgres after the column.
+const externalIDConstraint = "subscriptions_external_id_key"
+
+// isExternalIDViolation reports whether err was caused by a write violating
+// externalIDConstraint.
+func isExternalIDViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode && pgErr.ConstraintName == externalIDConstraint
+}
+
+// checkViolationCode is the Postgres SQLSTATE reported when a CHECK
+// constraint is violated.
+const checkViolationCode = "23514"
+
+// periodConstraint is the CHECK constraint keeping end_date from preceding
+// start_date.
+const periodConstraint = "subscriptions_period_check"
+
+// isPeriodViolation reports whether err was caused by a write violating
+// periodConstraint. The application checks periods itself first, so this
+// only catches what slips past them.
+func isPeriodViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == checkViolationCode && pgErr.ConstraintName == periodConstraint
+}
+
+// invertedPeriodError is the validation error returned when periodConstraint
+// rejects a write.
+func invertedPeriodError() error {
+	return &FieldError{Field: "end_date", Message: "must not be before start_date"}
+}
+
+// overlappingSubQuery finds a subscription of user $1 to service $2 whose
+// months overlap [$3, $4], both inclusive; a NULL end on either side means
+// open-ended. Subscriptions whose id is in $5 or, when $6 is not empty, whose
+// external_id is $6 are skipped.
+const overlappingSubQuery = `SELECT id FROM subscriptions
+	WHERE user_id = $1 AND service_name = $2 AND deleted_at IS NULL
+		AND start_date <= COALESCE($4::date, 'infinity'::date)
+		AND COALESCE(end_date, 'infinity'::date) >= $3
+		AND id <> ALL($5)
+		AND ($6 = '' OR external_id IS DISTINCT FROM $6)
+	ORDER BY id
+	LIMIT 1`
+
+// lockUserService takes a transaction-scoped advisory lock on the pair of
+// userId and serviceName. Writers holding it check for overlaps and insert
+// or update in the same transaction, so two concurrent requests for the same
+// user and service cannot both pass the overlap check. q must be a
+// transaction; the lock is released when it ends.
+func lockUserService(ctx context.Context, q querier, userId string, serviceName string) error {
+	if _, err := q.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1::text || '/' || $2::text, 0))`, userId, serviceName); err != nil {
+		return fmt.Errorf("failed to lock user subscriptions: %w", err)
+	}
+	return nil
+}
+
+// lockUserServices takes the lockUserService locks of several pairs of user
+// id and service name, skipping duplicates. The locks are taken in a fixed
+// order so that two transactions locking the same pairs cannot deadlock.
+func lockUserServices(ctx context.Context, q querier, keys ...[2]string) error {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		if err := lockUserService(ctx, q, key[0], key[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOverlap returns an error matching ErrConflict when the user
+// already has a subscription to serviceName active in any month from start
+// to end (nil for open-ended). Subscriptions listed in excludeIDs and the one
+// carrying excludeExternalID, if not empty, are ignored so a subscription
+// does not conflict with itself.
+func checkOverlap(ctx context.Context, q querier, userId string, serviceName string, start time.Time, end interface{}, excludeIDs []int, excludeExternalID string) error {
+	if excludeIDs == nil {
+		excludeIDs = []int{}
+	}
+	var id int
+	err := q.QueryRow(ctx, overlappingSubQuery, userId, serviceName, start, end, excludeIDs, excludeExternalID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check for overlapping subscriptions: %w", err)
+	}
+	return conflictf("overlapping subscription with id %d already covers this period for user %s and service %q", id, userId, serviceName)
+}
+
+// FieldError reports invalid input for a single field. Field uses the JSON
+// name of the field as sent by clients and Value echoes the rejected input,
+// so the error can be returned to the client as is.
+type FieldError struct {
+	Field   string `json:"field"`
+	Value   string `json:"value"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+// Is makes every FieldError match ErrValidation.
+func (e *FieldError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// numericOverflowCode is the Postgres SQLSTATE reported when a value does not
+// fit its column type, such as a price beyond the range of INTEGER.
+const numericOverflowCode = "22003"
+
+// maxStorablePrice is the largest price the INTEGER price column can hold.
+const maxStorablePrice = math.MaxInt32
+
+// errPriceOverflow is returned for prices the database cannot store.
+var errPriceOverflow = invalidf("price exceeds maximum storable value")
+
+// isNumericOverflow reports whether err was caused by a value out of range
+// for its column.
+func isNumericOverflow(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == numericOverflowCode
+}
+
+// checkPrice returns a validation error when price is negative, exceeds the
+// configured maximum or cannot be stored.
+func (r *SubscriptionsRepository) checkPrice(price int) error {
+	if price < 0 {
+		return invalidf("price must be non-negative")
+	}
+	if r.maxPrice > 0 && price > r.maxPrice {
+		return invalidf("price exceeds maximum of %d", r.maxPrice)
+	}
+	if price > maxStorablePrice {
+		return errPriceOverflow
+	}
+	return nil
+}
+
+// parseNewSub validates the price and parses the dates of a subscription
+// about to be created. The returned end value is nil for an open-ended
+// subscription so it can be passed directly as a query argument.
+func (r *SubscriptionsRepository) parseNewSub(price int, startDate string, endDate string) (time.Time, interface{}, error) {
+	if err := r.checkPrice(price); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	start, err := r.parseMonth(startDate)
+	if err != nil {
+		return time.Time{}, nil, invalidf("invalid startDate format: %w", err)
+	}
+
+	var endParam interface{} = nil
+	if endDate != "" {
+		endT, err := r.parseMonth(endDate)
+		if err != nil {
+			return time.Time{}, nil, invalidf("invalid endDate format: %w", err)
+		}
+		if err := checkPeriod(start, &endT); err != nil {
+			return time.Time{}, nil, err
+		}
+		endParam = endT
+	}
+	return start, endParam, nil
+}
+
+// DefaultCurrency is the currency of subscriptions created without one.
+const DefaultCurrency = "USD"
+
+// parseCurrency validates an ISO 4217 currency code, which must consist of
+// three uppercase letters, and returns it. An empty currency yields
+// DefaultCurrency.
+func parseCurrency(currency string) (string, error) {
+	if currency == "" {
+		return DefaultCurrency, nil
+	}
+	if len(currency) != 3 || strings.Trim(currency, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", &FieldError{Field: "currency", Value: currency, Message: "must be a 3-letter uppercase ISO 4217 code"}
+	}
+	return currency, nil
+}
+
+// subColumns lists the subscription columns in the order expected by
+// scanSub.
+const subColumns = "id, service_name, price, currency, user_id, start_date, end_date, status, external_id, created_at, updated_at, version"
+
+// scanSub scans a row selected with subColumns into a Subscription, followed
+// by any extra destinations for additional selected columns. Dates are
+// formatted as "MM-YYYY"; NULL end_date and external_id become empty strings.
+func scanSub(row pgx.Row, extra ...any) (entities.Subscription, error) {
+	var s entities.Subscription
+	var start time.Time
+	var end *time.Time
+	var externalID *string
+	dest := append([]any{&s.ID, &s.ServiceName, &s.Price, &s.Currency, &s.UserID, &start, &end, &s.Status, &externalID, &s.CreatedAt, &s.UpdatedAt, &s.Version}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return s, err
+	}
+
+	s.StartDate = start.Format(monthLayout)
+	if end != nil {
+		s.EndDate = end.Format(monthLayout)
+	}
+	if externalID != nil {
+		s.ExternalID = *externalID
+	}
+	return s, nil
+}
+
+// GetSub retrieves the subscription with the given id. Returns a pointer to
+// entities.Subscription or an error if the record is not found.
+func (r *SubscriptionsRepository) GetSub(ctx context.Context, id int) (*entities.Subscription, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	query := fmt.Sprintf("SELECT %s FROM subscriptions WHERE id = $1 AND deleted_at IS NULL", subColumns)
+	s, err := scanSub(r.db.QueryRow(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("GetSub: %w", notFoundf("subscription with id %d not found", id))
+		}
+		return nil, fmt.Errorf("GetSub: failed to scan subscription: %w", err)
+	}
+	return &s, nil
+}
+
+// GetSubByExternalID retrieves the subscription carrying the given external
+// billing system identifier, or returns an error if there is none.
+func (r *SubscriptionsRepository) GetSubByExternalID(ctx context.Context, externalID string) (*entities.Subscription, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	query := fmt.Sprintf("SELECT %s FROM subscriptions WHERE external_id = $1 AND deleted_at IS NULL", subColumns)
+	s, err := scanSub(r.db.QueryRow(ctx, query, externalID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("GetSubByExternalID: %w", notFoundf("subscription with external_id %q not found", externalID))
+		}
+		return nil, fmt.Errorf("GetSubByExternalID: failed to scan subscription: %w", err)
+	}
+	return &s, nil
+}
+
+// GetSubsByUser returns a page of the subscriptions of userID ordered by id,
+// together with the total number of them. A limit of 0 returns all rows from
+// offset on. Unlike GetSubsList it filters on user_id alone, which the
+// subscriptions_user_id_idx index serves. Soft-deleted subscriptions are
+// never listed.
+func (r *SubscriptionsRepository) GetSubsByUser(ctx context.Context, userID string, limit int, offset int) ([]entities.Subscription, int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if limit < 0 || offset < 0 {
+		return nil, 0, fmt.Errorf("GetSubsByUser: %w", invalidf("invalid page: limit and offset must be non-negative"))
+	}
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM subscriptions WHERE user_id = $1 AND deleted_at IS NULL`
+	if err := r.db.QueryRow(ctx, countQuery, userID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("GetSubsByUser: failed to count subscriptions: %w", err)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM subscriptions WHERE user_id = $1 AND deleted_at IS NULL ORDER BY id OFFSET $2", subColumns)
+	args := []interface{}{userID, offset}
+	if limit > 0 {
+		query += " LIMIT $3"
+		args = append(args, limit)
+	}
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetSubsByUser: failed to query subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subs := make([]entities.Subscription, 0)
+	for rows.Next() {
+		s, err := scanSub(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("GetSubsByUser: failed to scan subscription: %w", err)
+		}
+		subs = append(subs, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("GetSubsByUser: rows iteration error: %w", err)
+	}
+	return subs, total, nil
+}
+
+// GetTenure returns for how many whole months the subscription with the
+// given id has been active as of the month asOf ("MM-YYYY"). See
+// TenureMonths for how the months are counted.
+func (r *SubscriptionsRepository) GetTenure(ctx context.Context, id int, asOf string) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	asOfMonth, err := r.parseMonth(asOf)
+	if err != nil {
+		return 0, fmt.Errorf("GetTenure: %w", invalidf("invalid asOf format: %w", err))
+	}
+
+	query := `SELECT start_date, end_date FROM subscriptions WHERE id = $1 AND deleted_at IS NULL`
+	var start time.Time
+	var end *time.Time
+	if err := r.db.QueryRow(ctx, query, id).Scan(&start, &end); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("GetTenure: %w", notFoundf("subscription with id %d not found", id))
+		}
+		return 0, fmt.Errorf("GetTenure: failed to scan subscription: %w", err)
+	}
+	return TenureMonths(start, end, asOfMonth), nil
+}
+
+// HasActiveSub reports whether the user has at least one subscription active
+// in the month asOf ("MM-YYYY"), i.e. started no later than that month and
+// not ended before it. The check is a single EXISTS query, so it stops at
+// the first matching row.
+func (r *SubscriptionsRepository) HasActiveSub(ctx context.Context, userId string, asOf string) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	asOfMonth, err := r.parseMonth(asOf)
+	if err != nil {
+		return false, fmt.Errorf("HasActiveSub: %w", invalidf("invalid asOf format: %w", err))
+	}
+
+	query := `SELECT EXISTS (SELECT 1 FROM subscriptions WHERE user_id = $1 AND deleted_at IS NULL AND start_date <= $2 AND (end_date IS NULL OR end_date >= $2))`
+	var active bool
+	if err := r.db.QueryRow(ctx, query, userId, asOfMonth).Scan(&active); err != nil {
+		return false, fmt.Errorf("HasActiveSub: failed to query subscriptions: %w", err)
+	}
+	return active, nil
+}
+
+// TenureMonths returns the number of months between start and asOf, capped
+// at end for subscriptions that ended before asOf. Open-ended subscriptions
+// (nil end) are counted up to asOf and subscriptions starting after asOf
+// have a tenure of 0. Only the year and month of the arguments are used.
+func TenureMonths(start time.Time, end *time.Time, asOf time.Time) int {
+	to := asOf
+	if end != nil && end.Before(to) {
+		to = *end
+	}
+	months := (to.Year()-start.Year())*12 + int(to.Month()) - int(start.Month())
+	if months < 0 {
+		return 0
+	}
+	return months
+}
+
+// UpdateSub performs a partial update of subscription fields (except id).
+//
+// Any parameter set to nil will not be changed. A new serviceName is stored
+// normalized (see NormalizeServiceName). Dates must be in "MM-YYYY" format;
+// an empty string for endDate pointer (i.e. &"" passed) will clear the
+// end_date value in the database (set it to NULL); likewise an empty
+// externalID clears the external identifier. The method validates that price
+// is non-negative, that currency is a valid code (see parseCurrency) and that
+// there is at least one field to update, rejects changes that would make the
+// subscription overlap another one of the same user to the same service, and
+// returns a not-found error when no subscription has the given id.
+//
+// version is the version of the subscription the caller based the update
+// on. When the stored version differs, because the subscription was modified
+// in the meantime, a conflict error is returned and nothing is changed.
+// Otherwise the version is incremented and the new one is returned.
+func (r *SubscriptionsRepository) UpdateSub(ctx context.Context, id int, version int, serviceName *string, price *int, currency *string, userId *string, startDate *string, endDate *string, externalID *string) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	parts := make([]string, 0)
+	args := make([]interface{}, 0)
+	idx := 1
+
+	if serviceName != nil {
+		normalized := NormalizeServiceName(*serviceName)
+		serviceName = &normalized
+		parts = append(parts, fmt.Sprintf("service_name = $%d", idx))
+		args = append(args, normalized)
+		idx++
+	}
+	if price != nil {
+		if err := r.checkPrice(*price); err != nil {
+			return 0, fmt.Errorf("UpdateSub: %w", err)
+		}
+		parts = append(parts, fmt.Sprintf("price = $%d", idx))
+		args = append(args, *price)
+		idx++
+	}
+	if currency != nil {
+		if *currency == "" {
+			return 0, fmt.Errorf("UpdateSub: %w", &FieldError{Field: "currency", Message: "cannot be empty"})
+		}
+		if _, err := parseCurrency(*currency); err != nil {
+			return 0, fmt.Errorf("UpdateSub: %w", err)
+		}
+		parts = append(parts, fmt.Sprintf("currency = $%d", idx))
+		args = append(args, *currency)
+		idx++
+	}
+	if userId != nil {
+		parts = append(parts, fmt.Sprintf("user_id = $%d", idx))
+		args = append(args, *userId)
+		idx++
+	}
+	var newStart, newEnd *time.Time
+	if startDate != nil {
+		if *startDate == "" {
+			return 0, fmt.Errorf("UpdateSub: %w", &FieldError{Field: "start_date", Message: "cannot be empty"})
+		}
+		st, err := r.parseMonth(*startDate)
+		if err != nil {
+			return 0, fmt.Errorf("UpdateSub: %w", &FieldError{Field: "start_date", Value: *startDate, Message: err.Error()})
+		}
+		newStart = &st
+		parts = append(parts, fmt.Sprintf("start_date = $%d", idx))
+		args = append(args, st)
+		idx++
+	}
+	if endDate != nil {
+		if *endDate == "" {
+			parts = append(parts, fmt.Sprintf("end_date = $%d", idx))
+			args = append(args, nil)
+			idx++
+		} else {
+			et, err := r.parseMonth(*endDate)
+			if err != nil {
+				return 0, fmt.Errorf("UpdateSub: %w", &FieldError{Field: "end_date", Value: *endDate, Message: err.Error()})
+			}
+			newEnd = &et
+			parts = append(parts, fmt.Sprintf("end_date = $%d", idx))
+			args = append(args, et)
+			idx++
+		}
+	}
+	if externalID != nil {
+		parts = append(parts, fmt.Sprintf("external_id = NULLIF($%d, '')", idx))
+		args = append(args, *externalID)
+		idx++
+	}
+
+	if len(parts) == 0 {
+		return 0, fmt.Errorf("UpdateSub: %w", invalidf("no fields to update"))
+	}
+	parts = append(parts, "updated_at = now()", "version = version + 1")
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("UpdateSub: failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// The advisory locks of the current and the new user and service are
+	// taken before the row lock, in the order CreateSubClosingPrevious takes
+	// them, so the two cannot deadlock. The key is read without locking
+	// first and checked again once the row is locked.
+	var storedUser, storedService string
+	err = tx.QueryRow(ctx, `SELECT user_id, service_name FROM subscriptions WHERE id = $1 AND deleted_at IS NULL`, id).Scan(&storedUser, &storedService)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("UpdateSub: %w", notFoundf("subscription with id %d not found", id))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("UpdateSub: failed to load subscription: %w", err)
+	}
+	newUser, newService := storedUser, storedService
+	if userId != nil {
+		newUser = *userId
+	}
+	if serviceName != nil {
+		newService = *serviceName
+	}
+	if err := lockUserServices(ctx, tx, [2]string{storedUser, storedService}, [2]string{newUser, newService}); err != nil {
+		return 0, fmt.Errorf("UpdateSub: %w", err)
+	}
+
+	var stored int
+	var lockedUser, lockedService string
+	err = tx.QueryRow(ctx, `SELECT version, user_id, service_name FROM subscriptions WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id).Scan(&stored, &lockedUser, &lockedService)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("UpdateSub: %w", notFoundf("subscription with id %d not found", id))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("UpdateSub: failed to load subscription version: %w", err)
+	}
+	if lockedUser != storedUser || lockedService != storedService {
+		return 0, fmt.Errorf("UpdateSub: %w", conflictf("subscription %d has been modified concurrently", id))
+	}
+	if stored != version {
+		return 0, fmt.Errorf("UpdateSub: %w", conflictf("subscription %d has been modified: current version is %d, not %d", id, stored, version))
+	}
+
+	if err := r.onTx(tx).checkUpdatedSub(ctx, id, userId, serviceName, newStart, newEnd, endDate != nil); err != nil {
+		return 0, fmt.Errorf("UpdateSub: %w", err)
+	}
+
+	query := fmt.Sprintf("UPDATE subscriptions SET %s WHERE id = $%d AND version = $%d AND deleted_at IS NULL RETURNING version", strings.Join(parts, ", "), idx, idx+1)
+	args = append(args, id, version)
+
+	var newVersion int
+	if err := tx.QueryRow(ctx, query, args...).Scan(&newVersion); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("UpdateSub: %w", conflictf("subscription %d has been modified concurrently", id))
+		}
+		if isExternalIDViolation(err) && externalID != nil {
+			return 0, fmt.Errorf("UpdateSub: %w", conflictf("subscription with external_id %q already exists", *externalID))
+		}
+		if isUniqueViolation(err) {
+			return 0, fmt.Errorf("UpdateSub: %w", conflictf("subscription %d conflicts with an existing subscription", id))
+		}
+		if isNumericOverflow(err) {
+			return 0, fmt.Errorf("UpdateSub: %w", errPriceOverflow)
+		}
+		if isPeriodViolation(err) {
+			return 0, fmt.Errorf("UpdateSub: %w", invertedPeriodError())
+		}
+		return 0, fmt.Errorf("UpdateSub: failed to update subscription: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("UpdateSub: failed to commit transaction: %w", err)
+	}
+	return newVersion, nil
+}
+
+// checkUpdatedSub verifies that the subscription resulting from an update
+// has a period that is not inverted and does not overlap another
+// subscription of the same user to the same service. userId, serviceName and
+// newStart are the new values of fields that change, nil otherwise. endSet
+// tells whether end_date changes, to newEnd or to NULL when newEnd is nil.
+// Fields that do not change are loaded from the stored subscription, which
+// is locked FOR UPDATE, so r must run on a transaction. The caller must
+// already hold the lockUserService lock of the resulting user and service.
+func (r *SubscriptionsRepository) checkUpdatedSub(ctx context.Context, id int, userId *string, serviceName *string, newStart *time.Time, newEnd *time.Time, endSet bool) error {
+	if userId == nil && serviceName == nil && newStart == nil && !endSet {
+		return nil
+	}
+	var storedUser, storedService string
+	var storedStart time.Time
+	var storedEnd *time.Time
+	query := `SELECT user_id, service_name, start_date, end_date FROM subscriptions WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+	if err := r.db.QueryRow(ctx, query, id).Scan(&storedUser, &storedService, &storedStart, &storedEnd); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return notFoundf("subscription with id %d not found", id)
+		}
+		return fmt.Errorf("failed to load subscription: %w", err)
+	}
+	if userId == nil {
+		userId = &storedUser
+	}
+	if serviceName == nil {
+		serviceName = &storedService
+	}
+	if newStart == nil {
+		newStart = &storedStart
+	}
+	if !endSet {
+		newEnd = storedEnd
+	}
+	if err := checkPeriod(*newStart, newEnd); err != nil {
+		return err
+	}
+	var end interface{}
+	if newEnd != nil {
+		end = *newEnd
+	}
+	return checkOverlap(ctx, r.db, *userId, *serviceName, *newStart, end, []int{id}, "")
+}
+
+// checkPeriod reports a FieldError when end is before start. An open-ended
+// period (nil end) is always valid.
+func checkPeriod(start time.Time, end *time.Time) error {
+	if end != nil && end.Before(start) {
+		return &FieldError{Field: "end_date", Value: end.Format(monthLayout), Message: "must not be before start_date"}
+	}
+	return nil
+}
+
+// DeleteSub soft-deletes a subscription by id by setting its deleted_at, so
+// the record is kept for audits but no longer returned or counted. If no
+// rows are affected, because the subscription does not exist or is already
+// deleted, the method returns an error indicating that it was not found.
+func (r *SubscriptionsRepository) DeleteSub(ctx context.Context, id int) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	query := `UPDATE subscriptions SET deleted_at = now(), updated_at = now(), version = version + 1 WHERE id = $1 AND deleted_at IS NULL`
+	cmdTag, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("DeleteSub: failed to execute delete: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("DeleteSub: %w", notFoundf("subscription with id %d not found", id))
+	}
+	return nil
+}
+
+// DeleteSubsByUser soft-deletes every subscription of the given user, as
+// DeleteSub does for a single one, and returns how many were deleted. A user
+// without subscriptions is not an error: the count is then zero.
+func (r *SubscriptionsRepository) DeleteSubsByUser(ctx context.Context, userID string) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	query := `UPDATE subscriptions SET deleted_at = now(), updated_at = now(), version = version + 1 WHERE user_id = $1 AND deleted_at IS NULL`
+	cmdTag, err := r.db.Exec(ctx, query, userID)
+	if err != nil {
+		return 0, fmt.Errorf("DeleteSubsByUser: failed to execute delete: %w", err)
+	}
+	return int(cmdTag.RowsAffected()), nil
+}
+
+// RestoreSub brings back a subscription removed by DeleteSub. It returns a
+// not-found error when no soft-deleted subscription has the given id.
+func (r *SubscriptionsRepository) RestoreSub(ctx context.Context, id int) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	query := `UPDATE subscriptions SET deleted_at = NULL, updated_at = now(), version = version + 1 WHERE id = $1 AND deleted_at IS NOT NULL`
+	cmdTag, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("RestoreSub: failed to execute restore: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("RestoreSub: %w", notFoundf("deleted subscription with id %d not found", id))
+	}
+	return nil
+}
+
+// duplicatesListSource is used in place of the subscriptions table when a
+// listing is asked to annotate duplicates. It adds a has_duplicate column:
+// rows are partitioned by user and normalized service name and ordered by
+// start date, and a row overlaps another one in its partition when the latest
+// end date among the preceding rows reaches its start, or when the next row
+// starts before it ends. Open-ended subscriptions are treated as ending at
+// infinity. The flag is computed over all subscriptions that are not deleted
+// before any list filter is applied.
+const duplicatesListSource = `(SELECT *,
+	COALESCE(
+		MAX(COALESCE(end_date, 'infinity'::date)) OVER preceding >= start_date
+			OR LEAD(start_date) OVER partition_by_service <= COALESCE(end_date, 'infinity'::date),
+		false) AS has_duplicate
+FROM subscriptions
+WHERE deleted_at IS NULL
+WINDOW partition_by_service AS (PARTITION BY user_id, lower(trim(service_name)) ORDER BY start_date, id),
+	preceding AS (partition_by_service ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING)) AS s`
+
+// SubsListFilter holds the optional filters and flags applied by
+// GetSubsList. Nil pointer fields are not applied.
+//
+// UserID and ServiceName match the user_id and service_name columns exactly.
+//
+// StartDate and EndDate ("MM-YYYY") restrict the listing to a period. By
+// default a subscription matches when its interval overlaps the period, the
+// same rule GetTotalCost uses. With ExactPeriod set the given dates are
+// compared for equality instead: start_date must equal StartDate and
+// end_date must equal EndDate, so only subscriptions created for exactly that
+// term match. A bound that is not given is not constrained in either mode.
+//
+// When AnnotateDuplicates is true every returned subscription has
+// HasDuplicate set, telling whether the same user has another overlapping
+// subscription to the same service (compared case-insensitively, ignoring
+// surrounding whitespace).
+//
+// ServiceNameLike keeps the subscriptions whose service name contains it,
+// ignoring case; '%' and '_' in it match literally. It is independent of the
+// exact ServiceName match: when both are set, both must hold.
+//
+// CreatedFrom (inclusive) and CreatedBefore (exclusive) restrict the listing
+// by created_at, for example to a billing cycle computed with BillingCycle.
+//
+// ActiveOn keeps only the subscriptions active in that month: started no
+// later than it and either open-ended or ending no earlier than it.
+//
+// MinPrice and MaxPrice restrict the listing to a price band, both bounds
+// inclusive.
+//
+// SortBy orders the result by one of the fields in sortColumns ("id",
+// "price", "start_date", "service_name") or by "period_cost": each
+// subscription's cost over the period, price times the number of months it
+// overlaps [StartDate, EndDate], both inclusive, which requires both
+// StartDate and EndDate. An empty SortBy means "id". SortOrder is "asc" or
+// "desc"; when empty, period_cost sorts most expensive first and the other
+// fields ascending. Ties are broken by id.
+//
+// Limit and Offset select a page of the ordered result; a Limit of 0 returns
+// all rows from Offset on.
+type SubsListFilter struct {
+	UserID             *string
+	ServiceName        *string
+	ServiceNameLike    *string
+	StartDate          *string
+	EndDate            *string
+	ExactPeriod        bool
+	AnnotateDuplicates bool
+	CreatedFrom        *time.Time
+	CreatedBefore      *time.Time
+	ActiveOn           *time.Time
+	MinPrice           *int
+	MaxPrice           *int
+	SortBy             string
+	SortOrder          string
+	Limit              int
+	Offset             int
+}
+
+// BillingCycle returns the billing cycle containing now for cycles that
+// start on anchorDay of every month, as a [start, end) window in UTC. For
+// example, with anchorDay 15 and now on March 3rd the cycle runs from
+// February 15th to March 15th. anchorDay must be between 1 and 28 so that
+// every month has the day.
+func BillingCycle(now time.Time, anchorDay int) (time.Time, time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), anchorDay, 0, 0, 0, 0, time.UTC)
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start, start.AddDate(0, 1, 0)
+}
+
+// sortColumns maps the sort fields accepted by GetSubsList to the columns
+// they order by. Only these names are ever interpolated into ORDER BY.
+var sortColumns = map[string]string{
+	"id":           "id",
+	"price":        "price",
+	"start_date":   "start_date",
+	"service_name": "service_name",
+}
+
+// sortPeriodCost is the SortBy value ordering by cost over the period.
+const sortPeriodCost = "period_cost"
+
+// parseSort validates a sort field and order, returning the field ("id" when
+// empty) and whether to sort descending.
+func parseSort(sortBy string, order string) (string, bool, error) {
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	if _, ok := sortColumns[sortBy]; !ok && sortBy != sortPeriodCost {
+		return "", false, invalidf("invalid sort field %q", sortBy)
+	}
+	switch order {
+	case "":
+		return sortBy, sortBy == sortPeriodCost, nil
+	case "asc":
+		return sortBy, false, nil
+	case "desc":
+		return sortBy, true, nil
+	}
+	return "", false, invalidf("invalid sort order %q: must be asc or desc", order)
+}
+
+// periodCostExpr computes a subscription's cost over a period: its price
+// times the number of months in which it is active within the period, never
+// negative. It is formatted with the placeholder numbers of the period start
+// and end (first days of months, both inclusive).
+const periodCostExpr = `price * GREATEST(0,
+	(EXTRACT(YEAR FROM LEAST(COALESCE(end_date, $%[2]d), $%[2]d)) * 12 + EXTRACT(MONTH FROM LEAST(COALESCE(end_date, $%[2]d), $%[2]d)))
+	- (EXTRACT(YEAR FROM GREATEST(start_date, $%[1]d)) * 12 + EXTRACT(MONTH FROM GREATEST(start_date, $%[1]d)))
+	+ 1)`
+
+// listWhere builds the WHERE clause selecting the subscriptions matched by
+// filter, with placeholders numbered from $1, and its arguments. periodStart
+// and periodEnd are filter.StartDate and filter.EndDate already parsed.
+// Soft-deleted subscriptions are always excluded.
+func listWhere(filter SubsListFilter, periodStart *time.Time, periodEnd *time.Time) (string, []interface{}, error) {
+	parts := []string{"deleted_at IS NULL"}
+	args := make([]interface{}, 0)
+	idx := 1
+	if filter.UserID != nil {
+		parts = append(parts, fmt.Sprintf("user_id = $%d", idx))
+		args = append(args, *filter.UserID)
+		idx++
+	}
+	if filter.ServiceName != nil {
+		parts = append(parts, fmt.Sprintf("service_name = $%d", idx))
+		args = append(args, NormalizeServiceName(*filter.ServiceName))
+		idx++
+	}
+	if filter.ServiceNameLike != nil {
+		parts = append(parts, fmt.Sprintf("service_name ILIKE '%%' || $%d || '%%'", idx))
+		args = append(args, escapeLike(*filter.ServiceNameLike))
+		idx++
+	}
+	if filter.ExactPeriod {
+		if periodStart != nil {
+			parts = append(parts, fmt.Sprintf("start_date = $%d", idx))
+			args = append(args, *periodStart)
+			idx++
+		}
+		if periodEnd != nil {
+			parts = append(parts, fmt.Sprintf("end_date = $%d", idx))
+			args = append(args, *periodEnd)
+			idx++
+		}
+	} else if pred, predArgs := overlapPredicate(idx, periodStart, periodEnd); pred != "" {
+		parts = append(parts, pred)
+		args = append(args, predArgs...)
+		idx += len(predArgs)
+	}
+	if filter.CreatedFrom != nil {
+		parts = append(parts, fmt.Sprintf("created_at >= $%d", idx))
+		args = append(args, *filter.CreatedFrom)
+		idx++
+	}
+	if filter.CreatedBefore != nil {
+		parts = append(parts, fmt.Sprintf("created_at < $%d", idx))
+		args = append(args, *filter.CreatedBefore)
+		idx++
+	}
+	if filter.ActiveOn != nil {
+		parts = append(parts, fmt.Sprintf("start_date <= $%[1]d AND (end_date IS NULL OR end_date >= $%[1]d)", idx))
+		args = append(args, *filter.ActiveOn)
+		idx++
+	}
+	priceParts, priceArgs, err := priceRangePredicates(idx, filter.MinPrice, filter.MaxPrice)
+	if err != nil {
+		return "", nil, err
+	}
+	parts = append(parts, priceParts...)
+	args = append(args, priceArgs...)
+	return " WHERE " + strings.Join(parts, " AND "), args, nil
 }
 
-// NewSubscriptionsRepository creates a new SubscriptionsRepository connected
-// to the Postgres database described by cfg. The service parameter is used
-// only for logging/migration context inside the postgres package.
-func NewSubscriptionsRepository(ctx context.Context, cfg postgres.Config) (*SubscriptionsRepository, error) {
-	pool, err := postgres.New(ctx, cfg, "subscriptions_db")
+// likeEscaper escapes the LIKE wildcards and the default escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike makes s match itself literally inside a LIKE pattern, so a
+// substring search for "50%" does not treat '%' as a wildcard.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// GetSubsList returns the requested page of the subscriptions matching
+// filter, ordered as requested by filter.SortBy and filter.SortOrder,
+// together with the total number of matching subscriptions.
+// Soft-deleted subscriptions are never listed.
+func (r *SubscriptionsRepository) GetSubsList(ctx context.Context, filter SubsListFilter) ([]entities.Subscription, int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if filter.Limit < 0 || filter.Offset < 0 {
+		return nil, 0, fmt.Errorf("GetSubsList: %w", invalidf("invalid page: limit and offset must be non-negative"))
+	}
+	periodStart, periodEnd, err := r.parsePeriod(filter.StartDate, filter.EndDate)
 	if err != nil {
-		return nil, fmt.Errorf("NewSubscriptionsRepository: failed to connect to postgres: %w", err)
+		return nil, 0, fmt.Errorf("GetSubsList: %w", err)
+	}
+	sortBy, desc, err := parseSort(filter.SortBy, filter.SortOrder)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetSubsList: %w", err)
+	}
+	if sortBy == sortPeriodCost && (periodStart == nil || periodEnd == nil) {
+		return nil, 0, fmt.Errorf("GetSubsList: %w", invalidf("invalid sort: period_cost requires startDate and endDate"))
 	}
-	return &SubscriptionsRepository{pg: pool}, nil
-}
 
-// CreateSub inserts a new subscription record and returns the created id.
-//
-// startDate and endDate must be formatted as "MM-YYYY". endDate is optional
-// and may be an empty string to represent an open-ended subscription. Price
-// must be non-negative.
-func (r *SubscriptionsRepository) CreateSub(ctx context.Context, serviceName string, price int, userId string, startDate string, endDate string) (int, error) {
-	if price < 0 {
-		return 0, fmt.Errorf("CreateSub: price must be non-negative")
+	where, args, err := listWhere(filter, periodStart, periodEnd)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetSubsList: %w", err)
+	}
+	idx := len(args) + 1
+
+	var total int
+	if err := r.db.QueryRow(ctx, "SELECT COUNT(*) FROM subscriptions"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("GetSubsList: failed to count subscriptions: %w", err)
+	}
+
+	columns := subColumns
+	source := "subscriptions"
+	if filter.AnnotateDuplicates {
+		columns += ", has_duplicate"
+		source = duplicatesListSource
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s%s", columns, source, where)
+	direction := " ASC"
+	if desc {
+		direction = " DESC"
+	}
+	if sortBy == sortPeriodCost {
+		query += " ORDER BY " + fmt.Sprintf(periodCostExpr, idx, idx+1) + direction + ", id"
+		args = append(args, *periodStart, *periodEnd)
+		idx += 2
+	} else if sortBy == "id" {
+		query += " ORDER BY id" + direction
+	} else {
+		query += " ORDER BY " + sortColumns[sortBy] + direction + ", id"
+	}
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", idx)
+		args = append(args, filter.Limit)
+		idx++
+	}
+	if filter.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET $%d", idx)
+		args = append(args, filter.Offset)
 	}
 
-	start, err := time.Parse("01-2006", startDate)
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("CreateSub: invalid startDate format (expected MM-YYYY): %w", err)
+		return nil, 0, fmt.Errorf("GetSubsList: failed to query subscriptions: %w", err)
 	}
+	defer rows.Close()
 
-	var endParam interface{} = nil
-	if endDate != "" {
-		endT, err := time.Parse("01-2006", endDate)
+	subs := make([]entities.Subscription, 0)
+	for rows.Next() {
+		var extra []any
+		var hasDuplicate *bool
+		if filter.AnnotateDuplicates {
+			extra = append(extra, &hasDuplicate)
+		}
+		s, err := scanSub(rows, extra...)
 		if err != nil {
-			return 0, fmt.Errorf("CreateSub: invalid endDate format (expected MM-YYYY): %w", err)
+			return nil, 0, fmt.Errorf("GetSubsList: failed to scan subscription: %w", err)
 		}
-		endParam = endT
+		s.HasDuplicate = hasDuplicate
+		subs = append(subs, s)
 	}
 
-	query := `INSERT INTO subscriptions (service_name, price, user_id, start_date, end_date) VALUES ($1, $2, $3, $4, $5) RETURNING id`
-	var id int
-	row := r.pg.QueryRow(ctx, query, serviceName, price, userId, start, endParam)
-	if err := row.Scan(&id); err != nil {
-		return 0, fmt.Errorf("CreateSub: failed to insert subscription: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("GetSubsList: rows iteration error: %w", err)
 	}
-	return id, nil
+	return subs, total, nil
 }
 
-// GetSub retrieves the subscription with the given id. Returns a pointer to
-// entities.Subscription or an error if the record is not found.
-func (r *SubscriptionsRepository) GetSub(ctx context.Context, id int) (*entities.Subscription, error) {
-	query := `SELECT id, service_name, price, user_id, start_date, end_date FROM subscriptions WHERE id = $1`
-	var s entities.Subscription
-	var start time.Time
-	var end *time.Time
-	row := r.pg.QueryRow(ctx, query, id)
-	if err := row.Scan(&s.ID, &s.ServiceName, &s.Price, &s.UserID, &start, &end); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, fmt.Errorf("GetSub: subscription with id %d not found", id)
+// CountSubs returns the number of subscriptions matching filter, using the
+// same filters as GetSubsList without transferring any rows. The sorting and
+// paging fields of filter are ignored. Soft-deleted subscriptions are never
+// counted.
+func (r *SubscriptionsRepository) CountSubs(ctx context.Context, filter SubsListFilter) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	periodStart, periodEnd, err := r.parsePeriod(filter.StartDate, filter.EndDate)
+	if err != nil {
+		return 0, fmt.Errorf("CountSubs: %w", err)
+	}
+	where, args, err := listWhere(filter, periodStart, periodEnd)
+	if err != nil {
+		return 0, fmt.Errorf("CountSubs: %w", err)
+	}
+
+	var count int
+	if err := r.db.QueryRow(ctx, "SELECT COUNT(*) FROM subscriptions"+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("CountSubs: failed to count subscriptions: %w", err)
+	}
+	return count, nil
+}
+
+// TotalCostFilter selects the subscriptions summed by GetTotalCost. A nil
+// field is not applied.
+//
+// UserIDs restricts the sum to the subscriptions of the listed users; an
+// empty list does not filter on the user. ServiceName matches service_name
+// exactly. HasServiceName filters on the
+// presence of a service name instead: true keeps subscriptions with a
+// non-empty service_name and false keeps only those whose service_name is
+// the empty string. The two are independent, so an absent ServiceName never
+// means "service_name is empty".
+//
+// StartDate and EndDate, if provided, must be in the format "MM-YYYY" and
+// define the inclusive period for which subscriptions are considered. A
+// subscription is included if its interval overlaps the provided period.
+// Since price is a monthly amount, when both bounds are given each
+// subscription contributes its price times the number of months it is active
+// within the period. With an open-ended period (one or no bound) there is no
+// month count to multiply by and the raw prices are summed.
+//
+// ExcludeServices lists service names whose subscriptions are left out of the
+// sum, which answers "what would we pay without these services" questions.
+//
+// MinPrice and MaxPrice restrict the sum to subscriptions in a price band,
+// both bounds inclusive.
+//
+// Currency restricts the sum to subscriptions priced in that currency.
+// Prices in different currencies cannot be added up, so GetTotalCost rejects
+// a filter matching subscriptions in more than one currency.
+//
+// Fields holds additional column equality filters keyed by column name. Only
+// the columns listed in filterableColumns are accepted; the values are parsed
+// according to the column type.
+type TotalCostFilter struct {
+	UserIDs         []string
+	ServiceName     *string
+	HasServiceName  *bool
+	StartDate       *string
+	EndDate         *string
+	ExcludeServices []string
+	MinPrice        *int
+	MaxPrice        *int
+	Currency        *string
+	Fields          map[string]string
+}
+
+// filterableColumns whitelists the columns that may be used in generic
+// equality filters, mapping each one to the parser for its values. Adding a
+// column here is enough to make it filterable on the aggregate endpoints.
+var filterableColumns = map[string]func(string) (interface{}, error){
+	"user_id":      parseTextFilter,
+	"service_name": parseServiceNameFilter,
+	"status":       parseTextFilter,
+	"currency":     parseTextFilter,
+	"external_id":  parseTextFilter,
+	"price": func(v string) (interface{}, error) {
+		return strconv.Atoi(v)
+	},
+}
+
+func parseTextFilter(v string) (interface{}, error) {
+	return v, nil
+}
+
+func parseServiceNameFilter(v string) (interface{}, error) {
+	return NormalizeServiceName(v), nil
+}
+
+// fieldPredicates builds equality predicates for the generic field filters,
+// numbering placeholders from idx. Columns are processed in sorted order so
+// the generated query is stable. Unknown columns and values that do not parse
+// as the column type are rejected.
+func fieldPredicates(idx int, fields map[string]string) ([]string, []interface{}, error) {
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	parts := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+	for _, column := range columns {
+		parse, ok := filterableColumns[column]
+		if !ok {
+			return nil, nil, invalidf("invalid filter field %q", column)
 		}
-		return nil, fmt.Errorf("GetSub: failed to scan subscription: %w", err)
+		value, err := parse(fields[column])
+		if err != nil {
+			return nil, nil, invalidf("invalid filter value for %q: %w", column, err)
+		}
+		parts = append(parts, fmt.Sprintf("%s = $%d", column, idx))
+		args = append(args, value)
+		idx++
 	}
+	return parts, args, nil
+}
 
-	s.StartDate = start.Format("01-2006")
-	if end != nil {
-		s.EndDate = end.Format("01-2006")
-	} else {
-		s.EndDate = ""
+// priceRangePredicates builds the WHERE predicates for an inclusive price
+// band, numbering placeholders from idx. A nil bound is not applied. Bounds
+// must be non-negative and min must not exceed max.
+func priceRangePredicates(idx int, minPrice *int, maxPrice *int) ([]string, []interface{}, error) {
+	if minPrice != nil && *minPrice < 0 {
+		return nil, nil, invalidf("invalid min_price: must be non-negative")
+	}
+	if maxPrice != nil && *maxPrice < 0 {
+		return nil, nil, invalidf("invalid max_price: must be non-negative")
 	}
+	if minPrice != nil && maxPrice != nil && *minPrice > *maxPrice {
+		return nil, nil, invalidf("invalid price range: min_price %d is greater than max_price %d", *minPrice, *maxPrice)
+	}
+	parts := make([]string, 0, 2)
+	args := make([]interface{}, 0, 2)
+	if minPrice != nil {
+		parts = append(parts, fmt.Sprintf("price >= $%d", idx))
+		args = append(args, *minPrice)
+		idx++
+	}
+	if maxPrice != nil {
+		parts = append(parts, fmt.Sprintf("price <= $%d", idx))
+		args = append(args, *maxPrice)
+	}
+	return parts, args, nil
+}
 
-	return &s, nil
+// GetTotalCost calculates the cost of the subscriptions matching filter,
+// prorated by active months when a full period is given (see
+// TotalCostFilter). The function returns 0 when no matching subscriptions
+// are found.
+func (r *SubscriptionsRepository) GetTotalCost(ctx context.Context, filter TotalCostFilter) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	total, err := r.totalCost(ctx, r.db, filter, false)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
 }
 
-// UpdateSub performs a partial update of subscription fields (except id).
-//
-// Any parameter set to nil will not be changed. Dates must be in "MM-YYYY"
-// format; an empty string for endDate pointer (i.e. &"" passed) will clear
-// the end_date value in the database (set it to NULL). The method validates
-// that price is non-negative and that there is at least one field to update.
-func (r *SubscriptionsRepository) UpdateSub(ctx context.Context, id int, serviceName *string, price *int, userId *string, startDate *string, endDate *string) error {
-	parts := make([]string, 0)
+// GetTotalCostTx is GetTotalCost executed within tx. The summed rows are
+// locked with FOR UPDATE, so they cannot change until tx ends and the caller
+// can write records derived from the total (e.g. invoices) consistently.
+func (r *SubscriptionsRepository) GetTotalCostTx(ctx context.Context, tx pgx.Tx, filter TotalCostFilter) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	total, err := r.totalCost(ctx, r.bind(tx), filter, true)
+	if err != nil {
+		return 0, fmt.Errorf("GetTotalCostTx: %w", err)
+	}
+	return total, nil
+}
+
+// totalCost builds and runs the total cost query on q. With lock set the
+// matching rows are selected FOR UPDATE in a subquery, since Postgres does
+// not allow locking clauses together with aggregates. The distinct
+// currencies of the matching rows are selected along with the sum, and a sum
+// over more than one currency is rejected.
+func (r *SubscriptionsRepository) totalCost(ctx context.Context, q querier, filter TotalCostFilter, lock bool) (int, error) {
+	sumExpr, where, args, err := r.totalCostQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("SELECT COALESCE(SUM(%s),0)::bigint, array_agg(DISTINCT currency) FROM subscriptions%s", sumExpr, where)
+	if lock {
+		query = fmt.Sprintf("SELECT COALESCE(SUM(%s),0)::bigint, array_agg(DISTINCT currency) FROM (SELECT price, currency, start_date, end_date FROM subscriptions%s FOR UPDATE) locked", sumExpr, where)
+	}
+
+	var total int
+	var currencies []string
+	row := q.QueryRow(ctx, query, args...)
+	if err := row.Scan(&total, &currencies); err != nil {
+		return 0, fmt.Errorf("failed to scan total: %w", err)
+	}
+	if len(currencies) > 1 {
+		return 0, invalidf("invalid filter: matching subscriptions are priced in several currencies (%s); filter by currency", strings.Join(currencies, ", "))
+	}
+	return total, nil
+}
+
+// totalCostQuery translates filter into the per-row cost expression to sum,
+// the WHERE clause (starting with a space) and its arguments. Soft-deleted
+// subscriptions are always excluded.
+func (r *SubscriptionsRepository) totalCostQuery(filter TotalCostFilter) (string, string, []interface{}, error) {
+	parts := []string{"deleted_at IS NULL"}
 	args := make([]interface{}, 0)
 	idx := 1
 
-	if serviceName != nil {
+	if len(filter.UserIDs) > 0 {
+		parts = append(parts, fmt.Sprintf("user_id = ANY($%d)", idx))
+		args = append(args, filter.UserIDs)
+		idx++
+	}
+	if filter.ServiceName != nil {
 		parts = append(parts, fmt.Sprintf("service_name = $%d", idx))
-		args = append(args, *serviceName)
+		args = append(args, NormalizeServiceName(*filter.ServiceName))
 		idx++
 	}
-	if price != nil {
-		if *price < 0 {
-			return fmt.Errorf("UpdateSub: price must be non-negative")
+	if filter.HasServiceName != nil {
+		if *filter.HasServiceName {
+			parts = append(parts, "service_name <> ''")
+		} else {
+			parts = append(parts, "service_name = ''")
 		}
-		parts = append(parts, fmt.Sprintf("price = $%d", idx))
-		args = append(args, *price)
-		idx++
 	}
-	if userId != nil {
-		parts = append(parts, fmt.Sprintf("user_id = $%d", idx))
-		args = append(args, *userId)
+	if filter.Currency != nil {
+		parts = append(parts, fmt.Sprintf("currency = $%d", idx))
+		args = append(args, *filter.Currency)
 		idx++
 	}
-	if startDate != nil {
-		if *startDate == "" {
-			return fmt.Errorf("UpdateSub: startDate cannot be empty")
+	if len(filter.ExcludeServices) > 0 {
+		excluded := make([]string, len(filter.ExcludeServices))
+		for i, name := range filter.ExcludeServices {
+			excluded[i] = NormalizeServiceName(name)
 		}
-		st, err := time.Parse("01-2006", *startDate)
-		if err != nil {
-			return fmt.Errorf("UpdateSub: invalid startDate format (expected MM-YYYY): %w", err)
-		}
-		parts = append(parts, fmt.Sprintf("start_date = $%d", idx))
-		args = append(args, st)
+		parts = append(parts, fmt.Sprintf("service_name <> ALL($%d)", idx))
+		args = append(args, excluded)
 		idx++
 	}
-	if endDate != nil {
-		if *endDate == "" {
-			parts = append(parts, fmt.Sprintf("end_date = $%d", idx))
-			args = append(args, nil)
-			idx++
-		} else {
-			et, err := time.Parse("01-2006", *endDate)
-			if err != nil {
-				return fmt.Errorf("UpdateSub: invalid endDate format (expected MM-YYYY): %w", err)
-			}
-			parts = append(parts, fmt.Sprintf("end_date = $%d", idx))
-			args = append(args, et)
-			idx++
-		}
+	fieldParts, fieldArgs, err := fieldPredicates(idx, filter.Fields)
+	if err != nil {
+		return "", "", nil, err
+	}
+	parts = append(parts, fieldParts...)
+	args = append(args, fieldArgs...)
+	idx += len(fieldArgs)
+	priceParts, priceArgs, err := priceRangePredicates(idx, filter.MinPrice, filter.MaxPrice)
+	if err != nil {
+		return "", "", nil, err
 	}
+	parts = append(parts, priceParts...)
+	args = append(args, priceArgs...)
+	idx += len(priceArgs)
 
-	if len(parts) == 0 {
-		return fmt.Errorf("UpdateSub: no fields to update")
+	periodStart, periodEnd, err := r.parsePeriod(filter.StartDate, filter.EndDate)
+	if err != nil {
+		return "", "", nil, err
+	}
+	// overlapPredicate numbers the period start $idx and the end $idx+1.
+	sumExpr := "price"
+	if periodStart != nil && periodEnd != nil {
+		sumExpr = fmt.Sprintf(periodCostExpr, idx, idx+1)
+	}
+	if pred, predArgs := overlapPredicate(idx, periodStart, periodEnd); pred != "" {
+		parts = append(parts, pred)
+		args = append(args, predArgs...)
+		idx += len(predArgs)
 	}
 
-	query := fmt.Sprintf("UPDATE subscriptions SET %s WHERE id = $%d", strings.Join(parts, ", "), idx)
-	args = append(args, id)
+	where := " WHERE " + strings.Join(parts, " AND ")
+	return sumExpr, where, args, nil
+}
 
-	if _, err := r.pg.Exec(ctx, query, args...); err != nil {
-		return fmt.Errorf("UpdateSub: failed to update subscription: %w", err)
-	}
-	return nil
+// ServiceTotal is the total cost of the subscriptions to one service in one
+// currency.
+type ServiceTotal struct {
+	ServiceName string `json:"service_name"`
+	Currency    string `json:"currency"`
+	Total       int    `json:"total"`
 }
 
-// DeleteSub removes a subscription by id. If no rows are affected the method
-// returns an error indicating that the subscription was not found.
-func (r *SubscriptionsRepository) DeleteSub(ctx context.Context, id int) error {
-	query := `DELETE FROM subscriptions WHERE id = $1`
-	cmdTag, err := r.pg.Exec(ctx, query, id)
+// GetCostByService splits the total computed by GetTotalCost for filter by
+// service_name and currency, ordered by service name and currency, so a
+// service priced in several currencies gets one total per currency. It
+// returns an empty slice when no subscriptions match.
+func (r *SubscriptionsRepository) GetCostByService(ctx context.Context, filter TotalCostFilter) ([]ServiceTotal, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	sumExpr, where, args, err := r.totalCostQuery(filter)
 	if err != nil {
-		return fmt.Errorf("DeleteSub: failed to execute delete: %w", err)
+		return nil, fmt.Errorf("GetCostByService: %w", err)
 	}
-	if cmdTag.RowsAffected() == 0 {
-		return fmt.Errorf("DeleteSub: subscription with id %d not found", id)
+	query := fmt.Sprintf("SELECT service_name, currency, COALESCE(SUM(%s),0)::bigint FROM subscriptions%s GROUP BY service_name, currency ORDER BY service_name, currency", sumExpr, where)
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("GetCostByService: failed to query totals: %w", err)
 	}
-	return nil
+	defer rows.Close()
+
+	totals := make([]ServiceTotal, 0)
+	for rows.Next() {
+		var st ServiceTotal
+		if err := rows.Scan(&st.ServiceName, &st.Currency, &st.Total); err != nil {
+			return nil, fmt.Errorf("GetCostByService: failed to scan total: %w", err)
+		}
+		totals = append(totals, st)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetCostByService: rows iteration error: %w", err)
+	}
+	return totals, nil
+}
+
+// MonthTotal is the total cost of the subscriptions active in one month.
+// Month is formatted as "MM-YYYY".
+type MonthTotal struct {
+	Month string `json:"month"`
+	Total int    `json:"total"`
 }
 
-// GetSubsList returns all subscriptions from the database ordered by id.
-func (r *SubscriptionsRepository) GetSubsList(ctx context.Context) ([]entities.Subscription, error) {
-	query := `SELECT id, service_name, price, user_id, start_date, end_date FROM subscriptions ORDER BY id`
-	rows, err := r.pg.Query(ctx, query)
+// GetTrend returns, for each of the last months calendar months up to and
+// including the current one, the summed price of the subscriptions active in
+// that month. A subscription is active in a month when it started no later
+// than the month and has not ended before it, the same overlap rule used by
+// GetTotalCost for a one-month period. Months are returned in chronological
+// order and months without subscriptions have a total of 0. When currency is
+// not nil only subscriptions priced in it are counted; as for GetTotalCost,
+// prices in different currencies are not added up and a validation error is
+// returned when the counted subscriptions use several of them.
+func (r *SubscriptionsRepository) GetTrend(ctx context.Context, months int, currency *string) ([]MonthTotal, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if months <= 0 {
+		return nil, fmt.Errorf("GetTrend: %w", invalidf("months must be positive"))
+	}
+
+	query := `WITH window_months AS (
+			SELECT month::date FROM generate_series(
+				date_trunc('month', now())::date - make_interval(months => $1 - 1),
+				date_trunc('month', now())::date,
+				interval '1 month') AS g(month)
+		), matched AS (
+			SELECT price, currency, start_date, end_date FROM subscriptions
+			WHERE deleted_at IS NULL AND ($2::text IS NULL OR currency = $2)
+				AND start_date <= (SELECT max(month) FROM window_months)
+				AND (end_date IS NULL OR end_date >= (SELECT min(month) FROM window_months))
+		)
+		SELECT to_char(g.month, 'MM-YYYY'), COALESCE(SUM(m.price), 0)::bigint, (SELECT array_agg(DISTINCT currency) FROM matched)
+		FROM window_months g
+		LEFT JOIN matched m ON m.start_date <= g.month AND (m.end_date IS NULL OR m.end_date >= g.month)
+		GROUP BY g.month
+		ORDER BY g.month`
+	rows, err := r.db.Query(ctx, query, months, currency)
 	if err != nil {
-		return nil, fmt.Errorf("GetSubsList: failed to query subscriptions: %w", err)
+		return nil, fmt.Errorf("GetTrend: failed to query trend: %w", err)
 	}
 	defer rows.Close()
 
-	subs := make([]entities.Subscription, 0)
+	trend := make([]MonthTotal, 0, months)
+	var currencies []string
 	for rows.Next() {
-		var s entities.Subscription
-		var start time.Time
-		var end *time.Time
-		if err := rows.Scan(&s.ID, &s.ServiceName, &s.Price, &s.UserID, &start, &end); err != nil {
-			return nil, fmt.Errorf("GetSubsList: failed to scan subscription: %w", err)
-		}
-		s.StartDate = start.Format("01-2006")
-		if end != nil {
-			s.EndDate = end.Format("01-2006")
-		} else {
-			s.EndDate = ""
+		var mt MonthTotal
+		if err := rows.Scan(&mt.Month, &mt.Total, &currencies); err != nil {
+			return nil, fmt.Errorf("GetTrend: failed to scan month total: %w", err)
 		}
-		subs = append(subs, s)
+		trend = append(trend, mt)
 	}
-
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("GetSubsList: rows iteration error: %w", err)
+		return nil, fmt.Errorf("GetTrend: rows iteration error: %w", err)
 	}
-	return subs, nil
+	if len(currencies) > 1 {
+		return nil, fmt.Errorf("GetTrend: %w", invalidf("invalid filter: matching subscriptions are priced in several currencies (%s); filter by currency", strings.Join(currencies, ", ")))
+	}
+	return trend, nil
 }
 
-// GetTotalCost calculates the sum of subscription prices filtered by the
-// optional parameters. Any of the filter parameters can be nil to indicate
-// they should not be applied.
-//
-// startDate and endDate, if provided, must be in the format "MM-YYYY" and
-// define the inclusive period for which subscriptions are considered. A
-// subscription is included if its interval overlaps the provided period. The
-// function returns 0 when no matching subscriptions are found.
-func (r *SubscriptionsRepository) GetTotalCost(ctx context.Context, userId *string, serviceName *string, startDate *string, endDate *string) (int, error) {
-	parts := make([]string, 0)
-	args := make([]interface{}, 0)
-	idx := 1
+// GetCostTimeseries returns, for each month from filter.StartDate to
+// filter.EndDate inclusive, the summed price of the subscriptions matching
+// filter that are active in that month, using the same rule as GetTrend.
+// Both bounds are required; the period must not be inverted nor span more
+// than maxMonths months (unbounded when maxMonths is zero). As with
+// GetTotalCost, subscriptions priced in several currencies are not added up:
+// the filter must then select one currency.
+func (r *SubscriptionsRepository) GetCostTimeseries(ctx context.Context, filter TotalCostFilter, maxMonths int) ([]MonthTotal, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if filter.StartDate == nil || filter.EndDate == nil {
+		return nil, fmt.Errorf("GetCostTimeseries: %w", invalidf("startDate and endDate are required"))
+	}
+	periodStart, periodEnd, err := r.parsePeriod(filter.StartDate, filter.EndDate)
+	if err != nil {
+		return nil, fmt.Errorf("GetCostTimeseries: %w", err)
+	}
+	if periodEnd.Before(*periodStart) {
+		return nil, fmt.Errorf("GetCostTimeseries: %w", invalidf("endDate must not be before startDate"))
+	}
+	months := (periodEnd.Year()-periodStart.Year())*12 + int(periodEnd.Month()) - int(periodStart.Month()) + 1
+	if maxMonths > 0 && months > maxMonths {
+		return nil, fmt.Errorf("GetCostTimeseries: %w", invalidf("period spans %d months, at most %d are allowed", months, maxMonths))
+	}
 
-	if userId != nil {
-		parts = append(parts, fmt.Sprintf("user_id = $%d", idx))
-		args = append(args, *userId)
-		idx++
+	_, where, args, err := r.totalCostQuery(filter)
+	if err != nil {
+		return nil, fmt.Errorf("GetCostTimeseries: %w", err)
 	}
-	if serviceName != nil {
-		parts = append(parts, fmt.Sprintf("service_name = $%d", idx))
-		args = append(args, *serviceName)
-		idx++
+	// The period bounds are the last two arguments (see overlapPredicate).
+	query := fmt.Sprintf(`WITH matched AS (SELECT price, currency, start_date, end_date FROM subscriptions%s)
+		SELECT to_char(g.month, 'MM-YYYY'), COALESCE(SUM(m.price), 0)::bigint, (SELECT array_agg(DISTINCT currency) FROM matched)
+		FROM generate_series($%d::date, $%d::date, interval '1 month') AS g(month)
+		LEFT JOIN matched m ON m.start_date <= g.month AND (m.end_date IS NULL OR m.end_date >= g.month)
+		GROUP BY g.month
+		ORDER BY g.month`, where, len(args)-1, len(args))
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("GetCostTimeseries: failed to query timeseries: %w", err)
+	}
+	defer rows.Close()
+
+	series := make([]MonthTotal, 0, months)
+	var currencies []string
+	for rows.Next() {
+		var mt MonthTotal
+		if err := rows.Scan(&mt.Month, &mt.Total, &currencies); err != nil {
+			return nil, fmt.Errorf("GetCostTimeseries: failed to scan month total: %w", err)
+		}
+		series = append(series, mt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetCostTimeseries: rows iteration error: %w", err)
+	}
+	if len(currencies) > 1 {
+		return nil, fmt.Errorf("GetCostTimeseries: %w", invalidf("invalid filter: matching subscriptions are priced in several currencies (%s); filter by currency", strings.Join(currencies, ", ")))
 	}
+	return series, nil
+}
 
+// parsePeriod parses the optional bounds of a reporting period. A nil input
+// yields a nil bound; an empty string is rejected.
+func (r *SubscriptionsRepository) parsePeriod(startDate *string, endDate *string) (*time.Time, *time.Time, error) {
 	var periodStart, periodEnd *time.Time
 	if startDate != nil {
 		if *startDate == "" {
-			return 0, fmt.Errorf("GetTotalCost: startDate cannot be empty")
+			return nil, nil, invalidf("startDate cannot be empty")
 		}
-		st, err := time.Parse("01-2006", *startDate)
+		st, err := r.parseMonth(*startDate)
 		if err != nil {
-			return 0, fmt.Errorf("GetTotalCost: invalid startDate format (expected MM-YYYY): %w", err)
+			return nil, nil, invalidf("invalid startDate format: %w", err)
 		}
 		periodStart = &st
 	}
 	if endDate != nil {
 		if *endDate == "" {
-			return 0, fmt.Errorf("GetTotalCost: endDate cannot be empty")
+			return nil, nil, invalidf("endDate cannot be empty")
 		}
-		et, err := time.Parse("01-2006", *endDate)
+		et, err := r.parseMonth(*endDate)
 		if err != nil {
-			return 0, fmt.Errorf("GetTotalCost: invalid endDate format (expected MM-YYYY): %w", err)
+			return nil, nil, invalidf("invalid endDate format: %w", err)
 		}
 		periodEnd = &et
 	}
+	return periodStart, periodEnd, nil
+}
 
-	if periodStart != nil && periodEnd != nil {
-		parts = append(parts, fmt.Sprintf("start_date <= $%d AND (end_date IS NULL OR end_date >= $%d)", idx+1, idx))
-		args = append(args, *periodStart)
-		args = append(args, *periodEnd)
-		idx += 2
-	} else if periodStart != nil {
-		parts = append(parts, fmt.Sprintf("(end_date IS NULL OR end_date >= $%d)", idx))
-		args = append(args, *periodStart)
-		idx++
-	} else if periodEnd != nil {
-		parts = append(parts, fmt.Sprintf("start_date <= $%d", idx))
-		args = append(args, *periodEnd)
-		idx++
+// overlapPredicate returns a predicate matching subscriptions whose interval
+// overlaps the inclusive period [start, end], with placeholders numbered from
+// idx, together with its arguments. Either bound may be nil to leave that
+// side of the period open; an empty predicate is returned when both are nil.
+func overlapPredicate(idx int, start *time.Time, end *time.Time) (string, []interface{}) {
+	switch {
+	case start != nil && end != nil:
+		return fmt.Sprintf("start_date <= $%d AND (end_date IS NULL OR end_date >= $%d)", idx+1, idx), []interface{}{*start, *end}
+	case start != nil:
+		return fmt.Sprintf("(end_date IS NULL OR end_date >= $%d)", idx), []interface{}{*start}
+	case end != nil:
+		return fmt.Sprintf("start_date <= $%d", idx), []interface{}{*end}
 	}
+	return "", nil
+}
 
-	query := "SELECT COALESCE(SUM(price),0) FROM subscriptions"
-	if len(parts) > 0 {
-		query = fmt.Sprintf("%s WHERE %s", query, strings.Join(parts, " AND "))
+// NormalizeDates truncates start_date and end_date of every subscription to
+// the first day of their month and returns the number of rows that changed.
+//
+// Rows are processed in id order in batches of batchSize, each batch inside
+// its own transaction, so a large table is never locked as a whole and a
+// failure only rolls back the current batch. The query timeout applies to
+// each batch rather than to the whole run.
+func (r *SubscriptionsRepository) NormalizeDates(ctx context.Context, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("NormalizeDates: %w", invalidf("batch size must be positive"))
 	}
 
-	var total int
-	row := r.pg.QueryRow(ctx, query, args...)
-	if err := row.Scan(&total); err != nil {
-		return 0, fmt.Errorf("GetTotalCost: failed to scan total: %w", err)
+	updated := 0
+	lastID := 0
+	for {
+		ids, n, err := r.normalizeDatesBatch(ctx, lastID, batchSize)
+		if err != nil {
+			return updated, fmt.Errorf("NormalizeDates: %w", err)
+		}
+		if len(ids) == 0 {
+			return updated, nil
+		}
+		updated += n
+		lastID = ids[len(ids)-1]
 	}
-	return total, nil
+}
+
+// Statements of a NormalizeDates batch: select and lock the next batch of
+// ids, then truncate the dates of those rows that are not normalized yet.
+const (
+	normalizeSelectQuery = `SELECT id FROM subscriptions WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE`
+	normalizeUpdateQuery = `UPDATE subscriptions
+		SET start_date = date_trunc('month', start_date)::date,
+			end_date = date_trunc('month', end_date)::date,
+			updated_at = now(),
+			version = version + 1
+		WHERE id = ANY($1)
+			AND (start_date <> date_trunc('month', start_date)::date
+				OR end_date <> date_trunc('month', end_date)::date)`
+)
+
+// normalizeDatesBatch normalizes the dates of up to batchSize subscriptions
+// with ids above lastID in one transaction, bounded by the query timeout. It
+// returns the ids of the batch, empty when there are none left, and the
+// number of updated rows.
+func (r *SubscriptionsRepository) normalizeDatesBatch(ctx context.Context, lastID int, batchSize int) ([]int, int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rows, err := tx.Query(ctx, normalizeSelectQuery, lastID, batchSize)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to select batch: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to scan batch: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, 0, nil
+	}
+
+	cmdTag, err := tx.Exec(ctx, normalizeUpdateQuery, ids)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to update batch: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, 0, fmt.Errorf("failed to commit batch: %w", err)
+	}
+	return ids, int(cmdTag.RowsAffected()), nil
+}
+
+// GetExpiring returns the subscriptions whose end_date falls within the next
+// months calendar months, counting from the current month (inclusive), ordered
+// by end_date and then id. With months set to 1 only subscriptions ending in
+// the current month are returned. Open-ended subscriptions never expire and
+// are not returned.
+func (r *SubscriptionsRepository) GetExpiring(ctx context.Context, months int) ([]entities.Subscription, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if months <= 0 {
+		return nil, fmt.Errorf("GetExpiring: %w", invalidf("months must be positive"))
+	}
+
+	query := `SELECT ` + subColumns + ` FROM subscriptions
+		WHERE deleted_at IS NULL
+			AND end_date >= date_trunc('month', now())::date
+			AND end_date < date_trunc('month', now())::date + make_interval(months => $1)
+		ORDER BY end_date, id`
+	rows, err := r.db.Query(ctx, query, months)
+	if err != nil {
+		return nil, fmt.Errorf("GetExpiring: failed to query subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subs := make([]entities.Subscription, 0)
+	for rows.Next() {
+		s, err := scanSub(rows)
+		if err != nil {
+			return nil, fmt.Errorf("GetExpiring: failed to scan subscription: %w", err)
+		}
+		subs = append(subs, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetExpiring: rows iteration error: %w", err)
+	}
+	return subs, nil
+}
+
+// statusExpr computes the status a subscription should have right now: it is
+// "expired" once its end_date lies before the current month and "active"
+// otherwise (including open-ended subscriptions).
+const statusExpr = `CASE WHEN end_date < date_trunc('month', now())::date THEN 'expired' ELSE 'active' END`
+
+// MarkExpired brings the derived status column in line with end_date and
+// returns the number of rows that changed. Subscriptions whose end_date has
+// passed become "expired"; rows whose end_date was later moved forward or
+// cleared go back to "active". Only rows with a stale status are written, so
+// repeated calls are idempotent. The version is left alone: status follows
+// end_date, whose change already incremented it, so the flip must not make
+// clients' versions stale.
+func (r *SubscriptionsRepository) MarkExpired(ctx context.Context) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	query := fmt.Sprintf("UPDATE subscriptions SET status = %s WHERE status <> %s", statusExpr, statusExpr)
+	cmdTag, err := r.db.Exec(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("MarkExpired: failed to update statuses: %w", err)
+	}
+	return int(cmdTag.RowsAffected()), nil
 }
@@ -0,0 +1,446 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestCheckPrice(t *testing.T) {
+	const maxPrice = 10000000
+	tests := []struct {
+		name     string
+		maxPrice int
+		price    int
+		wantErr  string
+	}{
+		{"zero", maxPrice, 0, ""},
+		{"maximum", maxPrice, maxPrice, ""},
+		{"maximum plus one", maxPrice, maxPrice + 1, "price exceeds maximum of 10000000"},
+		{"negative", maxPrice, -1, "price must be non-negative"},
+		{"no maximum configured", 0, maxStorablePrice, ""},
+		{"beyond storable", 0, maxStorablePrice + 1, "price exceeds maximum storable value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &SubscriptionsRepository{maxPrice: tt.maxPrice}
+			err := r.checkPrice(tt.price)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkPrice(%d) = %v, want nil", tt.price, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkPrice(%d) = %v, want error containing %q", tt.price, err, tt.wantErr)
+			}
+			if !errors.Is(err, ErrValidation) {
+				t.Errorf("checkPrice(%d) error is not ErrValidation", tt.price)
+			}
+		})
+	}
+}
+
+func TestUpdateSubMissingID(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	name := "netflix"
+
+	_, err := r.UpdateSub(context.Background(), 999999, 1, &name, nil, nil, nil, nil, nil, nil)
+
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UpdateSub(999999) error = %v, want ErrNotFound", err)
+	}
+	if !strings.Contains(err.Error(), "not found") {
+		t.Errorf("UpdateSub(999999) error = %q, want it to mention \"not found\"", err)
+	}
+}
+
+const testUserID = "60601fee-2bf1-4721-ae6f-7636e79a0cba"
+
+// countSubs returns the number of rows in the subscriptions table, deleted
+// ones included.
+func countSubs(t *testing.T, r *SubscriptionsRepository) int {
+	t.Helper()
+	var n int
+	if err := r.pool.QueryRow(context.Background(), "SELECT count(*) FROM subscriptions").Scan(&n); err != nil {
+		t.Fatalf("failed to count subscriptions: %v", err)
+	}
+	return n
+}
+
+func TestCreateSubClosingPreviousRollsBackOnInsertError(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	ctx := context.Background()
+	prevID, err := r.CreateSub(ctx, "netflix", 400, "", testUserID, "01-2024", "", "")
+	if err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+	if _, err := r.CreateSub(ctx, "spotify", 200, "", testUserID, "01-2024", "", "ext-1"); err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+
+	// The previous subscription is closed before the insert fails on the
+	// duplicate external id.
+	_, _, err = r.CreateSubClosingPrevious(ctx, "netflix", 600, "", testUserID, "06-2024", "", "ext-1")
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("CreateSubClosingPrevious error = %v, want ErrConflict", err)
+	}
+
+	prev, err := r.GetSub(ctx, prevID)
+	if err != nil {
+		t.Fatalf("GetSub error: %v", err)
+	}
+	if prev.EndDate != "" || prev.Version != 1 {
+		t.Errorf("previous subscription end_date, version = %q, %d, want it left open at version 1", prev.EndDate, prev.Version)
+	}
+	if n := countSubs(t, r); n != 2 {
+		t.Errorf("subscriptions count = %d, want 2", n)
+	}
+}
+
+func TestCreateSubsBatchRollsBackOnItemError(t *testing.T) {
+	r := newTestRepository(t, Options{})
+
+	_, err := r.CreateSubsBatch(context.Background(), []NewSub{
+		{ServiceName: "netflix", Price: 400, UserID: testUserID, StartDate: "01-2024", ExternalID: "ext-1"},
+		{ServiceName: "spotify", Price: 200, UserID: testUserID, StartDate: "01-2024", ExternalID: "ext-1"},
+	})
+
+	var itemErr *BatchItemError
+	if !errors.As(err, &itemErr) || itemErr.Index != 1 {
+		t.Fatalf("CreateSubsBatch error = %v, want a BatchItemError for item 1", err)
+	}
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("CreateSubsBatch error = %v, want ErrConflict", err)
+	}
+	if n := countSubs(t, r); n != 0 {
+		t.Errorf("subscriptions count = %d, want 0 after the rollback", n)
+	}
+}
+
+// TestUpdateSubDoesNotDeadlockWithClosingPrevious moves a subscription to
+// another service while the previous subscriptions of that service are being
+// closed. Both take the advisory lock of the service before any row lock, so
+// every call must either succeed or fail with a conflict.
+func TestUpdateSubDoesNotDeadlockWithClosingPrevious(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	ctx := context.Background()
+
+	for i := range 20 {
+		id, err := r.CreateSub(ctx, "spotify", 200, "", testUserID, fmt.Sprintf("01-%d", 2000+i), fmt.Sprintf("01-%d", 2000+i), "")
+		if err != nil {
+			t.Fatalf("CreateSub error: %v", err)
+		}
+		if _, err := r.CreateSub(ctx, "netflix", 400, "", testUserID, fmt.Sprintf("02-%d", 2000+i), "", ""); err != nil && !errors.Is(err, ErrConflict) {
+			t.Fatalf("CreateSub error: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			service := "netflix"
+			_, errs[0] = r.UpdateSub(ctx, id, 1, &service, nil, nil, nil, nil, nil, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			_, _, errs[1] = r.CreateSubClosingPrevious(ctx, "netflix", 500, "", testUserID, fmt.Sprintf("03-%d", 2000+i), "", "")
+		}()
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil && !errors.Is(err, ErrConflict) {
+				t.Fatalf("iteration %d: error = %v, want nil or ErrConflict", i, err)
+			}
+		}
+	}
+}
+
+// newUnreachableRepository returns a repository whose pool points at a port
+// nothing listens on. The pool connects lazily, so it can be built without a
+// database.
+func newUnreachableRepository(t *testing.T, opts Options) *SubscriptionsRepository {
+	t.Helper()
+	pool, err := pgxpool.New(context.Background(), "postgres://user@127.0.0.1:1/subscriptions_db?sslmode=disable")
+	if err != nil {
+		t.Fatalf("pgxpool.New error: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return newSubscriptionsRepository(pool, opts)
+}
+
+func TestContextErrorsPropagate(t *testing.T) {
+	repos := map[string]func(t *testing.T, opts Options) *SubscriptionsRepository{
+		"unreachable": newUnreachableRepository,
+		"postgres":    newTestRepository,
+	}
+	for name, newRepo := range repos {
+		t.Run(name+"/canceled", func(t *testing.T) {
+			r := newRepo(t, Options{QueryTimeout: time.Minute})
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := r.GetSub(ctx, 1)
+
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("GetSub with a canceled context error = %v, want context.Canceled", err)
+			}
+		})
+		t.Run(name+"/timeout", func(t *testing.T) {
+			r := newRepo(t, Options{QueryTimeout: time.Nanosecond})
+
+			_, err := r.GetSub(context.Background(), 1)
+
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("GetSub past the query timeout error = %v, want context.DeadlineExceeded", err)
+			}
+		})
+	}
+}
+
+func TestPeriodConstraintRejectsInvertedInterval(t *testing.T) {
+	r := newTestRepository(t, Options{})
+
+	_, err := r.pool.Exec(context.Background(),
+		`INSERT INTO subscriptions (service_name, price, user_id, start_date, end_date) VALUES ('netflix', 400, $1, '2024-06-01', '2024-01-01')`, testUserID)
+
+	if !isPeriodViolation(err) {
+		t.Fatalf("inserting an inverted interval error = %v, want a %s violation", err, periodConstraint)
+	}
+	if n := countSubs(t, r); n != 0 {
+		t.Errorf("subscriptions count = %d, want 0", n)
+	}
+}
+
+func TestGetCostByServiceAggregatesCasings(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	ctx := context.Background()
+	users := []string{testUserID, "7f3c2a1e-9b4d-4c8e-a2f1-0d6e5b4a3c21", "b2e4d6f8-1a3c-4e5f-9a7b-8c6d4e2f0a13"}
+	for i, name := range []string{"Netflix", " netflix ", "NETFLIX"} {
+		if _, err := r.CreateSub(ctx, name, 100*(i+1), "", users[i], "01-2024", "", ""); err != nil {
+			t.Fatalf("CreateSub(%q) error: %v", name, err)
+		}
+	}
+
+	totals, err := r.GetCostByService(ctx, TotalCostFilter{})
+	if err != nil {
+		t.Fatalf("GetCostByService error: %v", err)
+	}
+
+	want := []ServiceTotal{{ServiceName: "netflix", Currency: DefaultCurrency, Total: 600}}
+	if len(totals) != len(want) || totals[0] != want[0] {
+		t.Errorf("GetCostByService = %+v, want %+v", totals, want)
+	}
+}
+
+func TestUpdateSubStaleVersion(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	ctx := context.Background()
+	id, err := r.CreateSub(ctx, "netflix", 400, "", testUserID, "01-2024", "", "")
+	if err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+	first, second := 500, 600
+
+	version, err := r.UpdateSub(ctx, id, 1, nil, &first, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("UpdateSub at version 1 error: %v", err)
+	}
+	if version != 2 {
+		t.Errorf("UpdateSub at version 1 = %d, want 2", version)
+	}
+
+	_, err = r.UpdateSub(ctx, id, 1, nil, &second, nil, nil, nil, nil, nil)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("stale UpdateSub error = %v, want ErrConflict", err)
+	}
+	sub, err := r.GetSub(ctx, id)
+	if err != nil {
+		t.Fatalf("GetSub error: %v", err)
+	}
+	if sub.Price != first || sub.Version != 2 {
+		t.Errorf("price, version = %d, %d after a stale update, want %d, 2", sub.Price, sub.Version, first)
+	}
+}
+
+func TestConcurrentUpsertsDoNotOverlap(t *testing.T) {
+	r := newTestRepository(t, Options{})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, errs[i] = r.UpsertByExternalID(context.Background(), fmt.Sprintf("ext-%d", i), "netflix", 400, "", testUserID, "01-2024", "")
+		}()
+	}
+	wg.Wait()
+
+	conflicts := 0
+	for _, err := range errs {
+		if errors.Is(err, ErrConflict) {
+			conflicts++
+		} else if err != nil {
+			t.Fatalf("UpsertByExternalID error = %v, want nil or ErrConflict", err)
+		}
+	}
+	if conflicts != 1 || countSubs(t, r) != 1 {
+		t.Errorf("got %d conflicts and %d subscriptions, want one of each", conflicts, countSubs(t, r))
+	}
+}
+
+func TestGetExpiringWindow(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	ctx := context.Background()
+	now := time.Now()
+	thisMonth := now.Format(monthLayout)
+	nextMonth := now.AddDate(0, 1, 1-now.Day()).Format(monthLayout)
+	users := []string{testUserID, "7f3c2a1e-9b4d-4c8e-a2f1-0d6e5b4a3c21"}
+	thisID, err := r.CreateSub(ctx, "netflix", 400, "", users[0], "01-2020", thisMonth, "")
+	if err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+	if _, err := r.CreateSub(ctx, "netflix", 400, "", users[1], "01-2020", nextMonth, ""); err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+
+	subs, err := r.GetExpiring(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetExpiring(1) error: %v", err)
+	}
+	if len(subs) != 1 || subs[0].ID != thisID {
+		t.Errorf("GetExpiring(1) = %+v, want only subscription %d ending in %s", subs, thisID, thisMonth)
+	}
+	if subs, err = r.GetExpiring(ctx, 2); err != nil || len(subs) != 2 {
+		t.Errorf("GetExpiring(2) = %d subscriptions, %v, want 2", len(subs), err)
+	}
+}
+
+func TestGetTrendRejectsMixedCurrencies(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	ctx := context.Background()
+	if _, err := r.CreateSub(ctx, "netflix", 400, "USD", testUserID, "01-2020", "", ""); err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+	if _, err := r.CreateSub(ctx, "spotify", 300, "EUR", testUserID, "01-2020", "", ""); err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+
+	if _, err := r.GetTrend(ctx, 2, nil); !errors.Is(err, ErrValidation) {
+		t.Errorf("GetTrend without currency error = %v, want ErrValidation", err)
+	}
+	currency := "EUR"
+	trend, err := r.GetTrend(ctx, 2, &currency)
+	if err != nil {
+		t.Fatalf("GetTrend(EUR) error: %v", err)
+	}
+	if len(trend) != 2 || trend[0].Total != 300 || trend[1].Total != 300 {
+		t.Errorf("GetTrend(EUR) = %+v, want 300 in both months", trend)
+	}
+}
+
+func TestMigrationVersion(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	migrations, err := filepath.Glob("../migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, dirty, err := r.MigrationVersion(context.Background())
+	if err != nil {
+		t.Fatalf("MigrationVersion error: %v", err)
+	}
+	if version != len(migrations) || dirty {
+		t.Errorf("MigrationVersion = %d, %t, want %d, false", version, dirty, len(migrations))
+	}
+}
+
+func TestMarkExpiredKeepsVersion(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	ctx := context.Background()
+	id, err := r.CreateSub(ctx, "netflix", 400, "", testUserID, "01-2020", "06-2020", "")
+	if err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+
+	if _, err := r.MarkExpired(ctx); err != nil {
+		t.Fatalf("MarkExpired error: %v", err)
+	}
+
+	sub, err := r.GetSub(ctx, id)
+	if err != nil {
+		t.Fatalf("GetSub error: %v", err)
+	}
+	if sub.Status != "expired" || sub.Version != 1 {
+		t.Errorf("status, version = %q, %d, want %q, 1", sub.Status, sub.Version, "expired")
+	}
+}
+
+func TestParseMonthAcceptsConfiguredLayouts(t *testing.T) {
+	r := newSubscriptionsRepository(nil, Options{DateLayouts: []string{"2006-01", "01/2006"}})
+	want := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for _, value := range []string{"03-2024", "2024-03", "03/2024"} {
+		got, err := r.ParseMonth(value)
+		if err != nil {
+			t.Errorf("ParseMonth(%q) error: %v", value, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("ParseMonth(%q) = %s, want %s", value, got, want)
+		}
+	}
+	if _, err := r.ParseMonth("2024/03"); err == nil {
+		t.Error("ParseMonth(\"2024/03\") = nil error, want an error listing the accepted formats")
+	}
+}
+
+func TestUniqueViolationClassification(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		unique     bool
+		externalID bool
+	}{
+		{"external id", &pgconn.PgError{Code: uniqueViolationCode, ConstraintName: externalIDConstraint}, true, true},
+		{"other unique constraint", &pgconn.PgError{Code: uniqueViolationCode, ConstraintName: "subscriptions_other_key"}, true, false},
+		{"check constraint", &pgconn.PgError{Code: checkViolationCode, ConstraintName: periodConstraint}, false, false},
+		{"wrapped", fmt.Errorf("insert: %w", &pgconn.PgError{Code: uniqueViolationCode, ConstraintName: externalIDConstraint}), true, true},
+	}
+	for _, tt := range tests {
+		if got := isUniqueViolation(tt.err); got != tt.unique {
+			t.Errorf("%s: isUniqueViolation = %t, want %t", tt.name, got, tt.unique)
+		}
+		if got := isExternalIDViolation(tt.err); got != tt.externalID {
+			t.Errorf("%s: isExternalIDViolation = %t, want %t", tt.name, got, tt.externalID)
+		}
+	}
+}
+
+func TestUpdateSubDuplicateExternalID(t *testing.T) {
+	r := newTestRepository(t, Options{})
+	ctx := context.Background()
+	if _, err := r.CreateSub(ctx, "netflix", 400, "", testUserID, "01-2024", "", "ext-1"); err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+	id, err := r.CreateSub(ctx, "spotify", 200, "", testUserID, "01-2024", "", "ext-2")
+	if err != nil {
+		t.Fatalf("CreateSub error: %v", err)
+	}
+	externalID := "ext-1"
+
+	_, err = r.UpdateSub(ctx, id, 1, nil, nil, nil, nil, nil, nil, &externalID)
+
+	if !errors.Is(err, ErrConflict) || !strings.Contains(err.Error(), `external_id "ext-1" already exists`) {
+		t.Errorf("UpdateSub to a taken external id error = %v, want an external_id conflict", err)
+	}
+}
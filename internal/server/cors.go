@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORS response header values. The allowed methods and headers cover every
+// endpoint of the API; the exposed headers are the custom response headers
+// browser clients may need to read.
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Accept, Content-Type, " + idempotencyKeyHeader + ", " + requestIDHeader + ", If-Match"
+	corsExposeHeaders = requestIDHeader + ", " + idempotentReplayedHeader + ", Retry-After, ETag"
+	corsMaxAge        = "600"
+)
+
+// cors returns a middleware that allows browsers on the given origins to call
+// the API. Requests whose Origin header is in allowedOrigins get the origin
+// echoed in Access-Control-Allow-Origin, and preflight requests (OPTIONS with
+// Access-Control-Request-Method) from those origins are answered with 204
+// and the allowed methods and headers without reaching the handlers. Other
+// origins get no CORS headers, so browsers block their requests. An empty
+// allowedOrigins disables the middleware.
+func cors(allowedOrigins []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed[origin] = true
+		}
+	}
+	if len(allowed) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !allowed[origin] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
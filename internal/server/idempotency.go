@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"task_effective_mobile/internal/repositories"
+)
+
+// idempotencyKeyHeader is the request header clients set to make a create
+// request safe to retry.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayedHeader is set on responses replayed for a known
+// idempotency key instead of being produced by a new insert.
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLen is the longest idempotency key accepted, matching the
+// idempotency_keys.key column.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyHash fingerprints a create request by its query string and
+// body, so a key replayed with different input can be detected.
+func idempotencyHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.URL.Query().Encode()))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// createIdempotent runs create under the idempotency key. The first request
+// with key performs create and records its response; a retry with the same
+// request returns the recorded response with replayed set instead of
+// creating another subscription.
+func createIdempotent(r *http.Request, repo *repositories.SubscriptionsRepository, key string, body []byte, create func(*repositories.SubscriptionsRepository) (map[string]int, error)) (map[string]int, bool, error) {
+	recorded, replayed, err := repo.RunIdempotent(r.Context(), key, idempotencyHash(r, body), func(txRepo *repositories.SubscriptionsRepository) (repositories.IdempotentResponse, error) {
+		resp, err := create(txRepo)
+		if err != nil {
+			return repositories.IdempotentResponse{}, err
+		}
+		encoded, err := json.Marshal(resp)
+		if err != nil {
+			return repositories.IdempotentResponse{}, fmt.Errorf("createIdempotent: failed to encode response: %w", err)
+		}
+		return repositories.IdempotentResponse{StatusCode: http.StatusCreated, Body: encoded}, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	var resp map[string]int
+	if err := json.Unmarshal(recorded.Body, &resp); err != nil {
+		return nil, false, fmt.Errorf("createIdempotent: failed to decode recorded response: %w", err)
+	}
+	return resp, replayed, nil
+}
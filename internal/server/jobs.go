@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"task_effective_mobile/internal/repositories"
+	"task_effective_mobile/pkg/logger"
+	"time"
+)
+
+// runExpiryJob marks subscriptions whose end_date has passed as expired,
+// once right away and then every interval, until ctx is canceled. Failures
+// are logged and retried on the next tick.
+func runExpiryJob(ctx context.Context, repo *repositories.SubscriptionsRepository, interval time.Duration) {
+	log := logger.GetLogger(ctx)
+	log.Info("runExpiryJob: started", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		updated, err := repo.MarkExpired(ctx)
+		if err != nil {
+			log.Error("runExpiryJob: failed to mark expired subscriptions", "error", err)
+		} else {
+			log.Info("runExpiryJob: refreshed subscription statuses", "updated", updated)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info("runExpiryJob: stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
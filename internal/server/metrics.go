@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"task_effective_mobile/internal/repositories"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors of the HTTP server. The metric
+// names are part of the service's monitoring contract and must not change:
+//
+//   - http_requests_total{method,path,status}: counter of served requests.
+//   - http_request_duration_seconds{method,path}: histogram of request
+//     latency.
+//   - http_requests_in_flight: gauge of requests being served.
+//   - db_pool_acquired_connections, db_pool_idle_connections and
+//     db_pool_total_connections: gauges of the Postgres pool sampled from
+//     pgxpool.Stat at scrape time.
+//
+// path is the path of the ServeMux pattern that matched the request (e.g.
+// "/subscriptions/{id}"), not the raw URL path, so ids do not create new
+// series. Requests matching no pattern are labeled "unmatched".
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inflight prometheus.Gauge
+}
+
+// newMetrics creates the collectors on a dedicated registry, along with the
+// standard Go runtime and process collectors and the pool gauges of repo.
+func newMetrics(repo *repositories.SubscriptionsRepository) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests served, by method, route and status code.",
+		}, []string{"method", "path", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Latency of HTTP requests, by method and route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "path"}),
+		inflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests currently being served.",
+		}),
+	}
+	poolGauge := func(name string, help string, value func(*repositories.PoolStats) int32) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 {
+			return float64(value(repo.PoolStats()))
+		})
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.inflight,
+		poolGauge("db_pool_acquired_connections", "Number of Postgres pool connections currently in use.",
+			func(s *repositories.PoolStats) int32 { return s.AcquiredConns }),
+		poolGauge("db_pool_idle_connections", "Number of idle Postgres pool connections.",
+			func(s *repositories.PoolStats) int32 { return s.IdleConns }),
+		poolGauge("db_pool_total_connections", "Total number of Postgres pool connections.",
+			func(s *repositories.PoolStats) int32 { return s.TotalConns }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler returns the /metrics endpoint exposing the registry.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument returns a middleware recording the request metrics. routes is
+// the ServeMux the requests are eventually dispatched to; it is only asked
+// for the matching pattern, which is used as the path label.
+func (m *metrics) instrument(routes *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := routeLabel(routes, r)
+		method := methodLabel(r.Method)
+
+		m.inflight.Inc()
+		defer m.inflight.Dec()
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		m.duration.WithLabelValues(method, path).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(method, path, strconv.Itoa(sw.status)).Inc()
+	})
+}
+
+// methodLabel returns method for the standard HTTP methods and "OTHER"
+// otherwise, so arbitrary client input cannot create new series.
+// routeLabel returns the path label of r: the pattern routes matches it
+// with, without its method.
+func routeLabel(routes *http.ServeMux, r *http.Request) string {
+	_, pattern := routes.Handler(r)
+	if pattern == "" {
+		return "unmatched"
+	}
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
+
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
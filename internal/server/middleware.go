@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"task_effective_mobile/internal/repositories"
+	"task_effective_mobile/pkg/logger"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// inflightRetryAfter is the value, in seconds, of the Retry-After header sent
+// when the in-flight request limit is exceeded.
+const inflightRetryAfter = "1"
+
+// inflightLimit returns a middleware that caps the number of requests being
+// served concurrently at limit. Requests arriving while the cap is reached
+// are rejected immediately with 503 Service Unavailable and a Retry-After
+// header instead of queueing up on the database pool. A non-positive limit
+// disables the cap. Either way inflight holds the number of requests being
+// served, which the shutdown path logs while draining.
+//
+// Unlike per-client rate limiting this is a global concurrency bound that
+// protects shared resources such as the Postgres connection pool.
+func inflightLimit(limit int, inflight *atomic.Int64, next http.Handler) http.Handler {
+	counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight.Add(1)
+		defer inflight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+	if limit <= 0 {
+		return counted
+	}
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			counted.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", inflightRetryAfter)
+			writeError(w, r, http.StatusServiceUnavailable, "server is busy, retry later")
+			logger.GetLogger(r.Context()).Warn("inflightLimit: in-flight request limit reached", "limit", limit, "method", r.Method, "path", r.URL.Path)
+		}
+	})
+}
+
+// recoverPanic returns a middleware that turns a panic in next into a JSON
+// 500 Internal Server Error. The panic value and stack are logged through the
+// request logger, so they carry the request ID. When next has already sent
+// the response headers the 500 can no longer be sent, so the panic is only
+// logged and the response is aborted with http.ErrAbortHandler, which
+// net/http uses to cut a response short on purpose and which is re-panicked
+// unchanged when next raises it itself.
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			logger.GetLogger(r.Context()).Error("recoverPanic: handler panicked",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(rec),
+				"stack", string(debug.Stack()),
+				"headers_sent", sw.status != 0,
+			)
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(w, r, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// debugSQLHeader is the response header listing the SQL executed for the
+// request when DEBUG_SQL is enabled.
+const debugSQLHeader = "X-Debug-SQL"
+
+// debugSQL returns a middleware that attaches a repositories.SQLRecorder to
+// each request context and reports the recorded statements in the
+// X-Debug-SQL response header. It must only be installed in development.
+func debugSQL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, rec := repositories.WithSQLRecorder(r.Context())
+		next.ServeHTTP(&debugSQLWriter{ResponseWriter: w, rec: rec}, r.WithContext(ctx))
+	})
+}
+
+// debugSQLWriter sets the X-Debug-SQL header just before the status line is
+// written, when the handler has already run its queries.
+type debugSQLWriter struct {
+	http.ResponseWriter
+	rec         *repositories.SQLRecorder
+	wroteHeader bool
+}
+
+func (w *debugSQLWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if sql := w.rec.String(); sql != "" {
+			w.Header().Set(debugSQLHeader, sql)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *debugSQLWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// requestIDHeader carries the correlation ID of a request in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds the length of a client-supplied request ID so that
+// arbitrary header values are not copied into every log line.
+const maxRequestIDLen = 128
+
+// requestID returns a middleware that assigns every request a correlation ID:
+// the incoming X-Request-ID header when present and reasonably short, or a
+// new UUID otherwise. The ID is echoed in the X-Request-ID response header
+// and attached as request_id to a request-scoped copy of the logger stored in
+// ctx, which handlers obtain with logger.GetLogger(r.Context()).
+func requestID(ctx context.Context, next http.Handler) http.Handler {
+	base := logger.GetLogger(ctx)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLen {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		reqCtx := logger.WithLogger(r.Context(), base.With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
+
+// accessLog returns a middleware that logs one line per request with its
+// method, path, response status, body size in bytes and duration.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		logger.GetLogger(r.Context()).Info("accessLog: request served",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// statusWriter records the status code and the number of body bytes written
+// through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"task_effective_mobile/pkg/logger"
+	"testing"
+)
+
+func TestInflightLimitCountsRequests(t *testing.T) {
+	for _, limit := range []int{0, 2} {
+		var inflight atomic.Int64
+		var during int64
+		handler := inflightLimit(limit, &inflight, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			during = inflight.Load()
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/subscriptions", nil))
+
+		if during != 1 {
+			t.Errorf("limit %d: in-flight count while serving = %d, want 1", limit, during)
+		}
+		if n := inflight.Load(); n != 0 {
+			t.Errorf("limit %d: in-flight count after serving = %d, want 0", limit, n)
+		}
+	}
+}
+
+func TestRecoverPanicAfterHeadersSent(t *testing.T) {
+	handler := recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"partial":`))
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions", nil)
+	req = req.WithContext(logger.WithLogger(req.Context(), slog.New(slog.DiscardHandler)))
+
+	func() {
+		defer func() {
+			if rec := recover(); rec != http.ErrAbortHandler {
+				t.Errorf("recovered %v, want http.ErrAbortHandler", rec)
+			}
+		}()
+		handler.ServeHTTP(rec, req)
+	}()
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want the %d already sent", rec.Code, http.StatusOK)
+	}
+	if body := rec.Body.String(); body != `{"partial":` {
+		t.Errorf("body = %q, want only the partial response", body)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"task_effective_mobile/pkg/logger"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Eviction settings of the per-client rate limiter: buckets of clients not
+// seen for rateLimitIdleTTL are dropped every rateLimitSweepInterval.
+const (
+	rateLimitIdleTTL       = 3 * time.Minute
+	rateLimitSweepInterval = time.Minute
+)
+
+// clientLimiter is the token bucket of one client and when it was last used.
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientLimiters holds a token bucket per client key.
+type clientLimiters struct {
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+	rps     rate.Limit
+	burst   int
+}
+
+// allow takes a token from the bucket of key, creating the bucket on first use.
+func (l *clientLimiters) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c.limiter.AllowN(now, 1)
+}
+
+// evict drops the buckets of clients idle since before cutoff.
+func (l *clientLimiters) evict(cutoff time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	evicted := 0
+	for key, c := range l.clients {
+		if c.lastSeen.Before(cutoff) {
+			delete(l.clients, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// rateLimit returns a middleware that limits each client to rps requests per
+// second on average with bursts of up to burst requests, using a token bucket
+// per client. Requests over the limit are rejected with 429 Too Many Requests
+// and a Retry-After header. A non-positive rps disables the middleware.
+//
+// Clients are keyed by the remote IP address. With trustForwarded set the
+// last address of the X-Forwarded-For header is used instead, which is the
+// one added by the proxy in front of the service; only enable it behind
+// such a proxy, as clients can send the header themselves. Buckets of idle
+// clients are evicted in the background until ctx is canceled.
+func rateLimit(ctx context.Context, rps float64, burst int, trustForwarded bool, next http.Handler) http.Handler {
+	if rps <= 0 {
+		return next
+	}
+	limiters := &clientLimiters{clients: make(map[string]*clientLimiter), rps: rate.Limit(rps), burst: burst}
+	go func() {
+		ticker := time.NewTicker(rateLimitSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				limiters.evict(now.Add(-rateLimitIdleTTL))
+			}
+		}
+	}()
+	retryAfter := strconv.Itoa(int(math.Ceil(1 / rps)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientKey(r, trustForwarded)
+		if !limiters.allow(key, time.Now()) {
+			w.Header().Set("Retry-After", retryAfter)
+			writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded, retry later")
+			logger.GetLogger(r.Context()).Warn("rateLimit: rate limit exceeded", "client", key, "method", r.Method, "path", r.URL.Path)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies the client of r for rate limiting: the last
+// X-Forwarded-For address when trustForwarded is set and the header is
+// present, otherwise the host part of the remote address.
+func clientKey(r *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"task_effective_mobile/internal/entities"
+	"task_effective_mobile/pkg/logger"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Media types the API can encode responses in.
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeMsgpack = "application/msgpack"
+)
+
+// writeResponse encodes v with the given status code in the format
+// negotiated from the request's Accept header. JSON is the default;
+// MessagePack is used when the client prefers application/msgpack (or the
+// legacy application/x-msgpack). MessagePack output uses the same field
+// names as JSON.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v any) error {
+	if negotiateContentType(r) == contentTypeMsgpack {
+		w.Header().Set("Content-Type", contentTypeMsgpack)
+		w.WriteHeader(status)
+		enc := msgpack.NewEncoder(w)
+		enc.SetCustomStructTag("json")
+		return enc.Encode(v)
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// APIError describes a single problem with a request. Code is a stable
+// machine-readable identifier, Field names the offending input field (when
+// the problem concerns one) and Value echoes the rejected input.
+type APIError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse is the envelope of every error response: the HTTP status
+// repeated in the body and one or more errors.
+type ErrorResponse struct {
+	Status int        `json:"status"`
+	Errors []APIError `json:"errors"`
+}
+
+// Stable error codes carried in APIError.Code. Clients should branch on
+// these rather than on messages.
+const (
+	codeValidation           = "validation_error"
+	codeInvalidField         = "invalid_field"
+	codeBadRequest           = "bad_request"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codeIdempotencyKeyReused = "idempotency_key_reused"
+	codeInternal             = "internal_error"
+	codeTimeout              = "timeout"
+	codeClientClosedRequest  = "client_closed_request"
+	codeUnavailable          = "unavailable"
+)
+
+// errorCode returns the default error code for status. Statuses without a
+// dedicated code fall back to their reason phrase, e.g. "payload_too_large".
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeBadRequest
+	case http.StatusUnprocessableEntity:
+		return codeValidation
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusInternalServerError:
+		return codeInternal
+	case http.StatusGatewayTimeout:
+		return codeTimeout
+	case statusClientClosedRequest:
+		return codeClientClosedRequest
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// writeErrors writes errs in the ErrorResponse envelope with the given
+// status, encoded like any other response.
+func writeErrors(w http.ResponseWriter, r *http.Request, status int, errs ...APIError) {
+	_ = writeResponse(w, r, status, ErrorResponse{Status: status, Errors: errs})
+}
+
+// writeJSONError writes a single error with an explicit code.
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	writeErrors(w, r, status, APIError{Code: code, Message: message})
+}
+
+// writeError writes a single error with the default code for status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeJSONError(w, r, status, errorCode(status), message)
+}
+
+// statusClientClosedRequest is the non-standard status (popularized by nginx)
+// recorded for requests abandoned by the client before a response was ready.
+const statusClientClosedRequest = 499
+
+// writeServerError answers a failed operation with 500 Internal Server Error
+// and msg followed by err. When err was caused by an exceeded deadline (a
+// request or database query timeout) it answers 504 Gateway Timeout instead,
+// telling the client that retrying may succeed. When the client canceled the
+// request it answers 499; nobody reads that response, but it keeps the access
+// log and metrics from counting the cancellation as a server failure.
+func writeServerError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.GetLogger(r.Context()).Warn("writeServerError: database deadline exceeded", "path", r.URL.Path, "error", err)
+		writeError(w, r, http.StatusGatewayTimeout, fmt.Sprintf("%s: request timed out, retry later", msg))
+	case errors.Is(err, context.Canceled):
+		logger.GetLogger(r.Context()).Info("writeServerError: request canceled by client", "path", r.URL.Path)
+		writeError(w, r, statusClientClosedRequest, fmt.Sprintf("%s: request canceled", msg))
+	default:
+		writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("%s: %v", msg, err))
+	}
+}
+
+// routeErrors wraps mux so that requests it cannot route are answered in the
+// error envelope instead of the plain-text defaults of http.ServeMux: 404 for
+// unknown paths and 405 for known paths requested with a method they do not
+// support, keeping the Allow header the mux computed from its patterns.
+// Other responses of the mux, such as redirects, are passed through.
+func routeErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(&routeErrorWriter{ResponseWriter: w, r: r}, r)
+	})
+}
+
+// routeErrorWriter replaces the plain-text 404 and 405 responses written by
+// http.ServeMux with the error envelope and discards their body.
+type routeErrorWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (w *routeErrorWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		w.replaced = true
+		writeError(w.ResponseWriter, w.r, status, fmt.Sprintf("no route for %s", w.r.URL.Path))
+	case http.StatusMethodNotAllowed:
+		w.replaced = true
+		writeError(w.ResponseWriter, w.r, status, "method not allowed")
+	default:
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *routeErrorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// negotiateContentType returns the response media type for r: the first
+// supported type listed in the Accept header, or JSON when none is listed.
+func negotiateContentType(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case contentTypeMsgpack, "application/x-msgpack":
+			return contentTypeMsgpack
+		case contentTypeJSON, "application/*", "*/*":
+			return contentTypeJSON
+		}
+	}
+	return contentTypeJSON
+}
+
+// subscriptionResponse is the representation of a subscription returned by
+// the API. It embeds the entity and adds computed fields that are only
+// included when asked for with the "with" query parameter.
+type subscriptionResponse struct {
+	entities.Subscription
+	Period string `json:"period,omitempty"`
+	// MonthsRemaining is only set when requested. It points to a nil *int
+	// for open-ended subscriptions so they are encoded as null rather than
+	// omitted.
+	MonthsRemaining **int `json:"months_remaining,omitempty"`
+}
+
+// parseWith collects the optional response fields requested through the
+// "with" query parameter. The parameter may be repeated or hold a
+// comma-separated list, e.g. ?with=period,remaining. Unknown names are ignored.
+func parseWith(q url.Values) map[string]bool {
+	with := make(map[string]bool)
+	for _, v := range q["with"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				with[name] = true
+			}
+		}
+	}
+	return with
+}
+
+// Values of the date_format query parameter.
+const (
+	dateFormatMonth = "month"
+	dateFormatISO   = "iso"
+)
+
+// responseOptions controls how subscriptions are rendered: the computed
+// fields named in with and the format of start_date and end_date.
+type responseOptions struct {
+	with       map[string]bool
+	dateFormat string
+}
+
+// parseResponseOptions reads the "with" and "date_format" query parameters.
+// date_format is month for MM-YYYY dates (the default) or iso for
+// YYYY-MM-01 dates.
+func parseResponseOptions(q url.Values) (responseOptions, error) {
+	opts := responseOptions{with: parseWith(q), dateFormat: dateFormatMonth}
+	switch v := q.Get("date_format"); v {
+	case "", dateFormatMonth:
+	case dateFormatISO:
+		opts.dateFormat = dateFormatISO
+	default:
+		return opts, fmt.Errorf("invalid date_format %q: must be month or iso", v)
+	}
+	return opts, nil
+}
+
+// isoDate converts a MM-YYYY month to the ISO 8601 date of its first day,
+// e.g. "07-2025" to "2025-07-01". Other values, such as an empty end date,
+// are returned unchanged.
+func isoDate(month string) string {
+	t, err := time.Parse("01-2006", month)
+	if err != nil {
+		return month
+	}
+	return t.Format(time.DateOnly)
+}
+
+// newSubscriptionResponse builds the response for s including the computed
+// fields named in opts, with dates in the format opts asks for.
+func newSubscriptionResponse(s entities.Subscription, opts responseOptions) subscriptionResponse {
+	resp := subscriptionResponse{Subscription: s}
+	if opts.with["period"] {
+		resp.Period = s.ISOPeriod()
+	}
+	if opts.with["remaining"] {
+		remaining := s.MonthsRemaining(time.Now())
+		resp.MonthsRemaining = &remaining
+	}
+	if opts.dateFormat == dateFormatISO {
+		resp.StartDate = isoDate(s.StartDate)
+		resp.EndDate = isoDate(s.EndDate)
+	}
+	return resp
+}
+
+// subscriptionsPage is one page of a subscription listing. Total is the
+// number of subscriptions matching the filters across all pages.
+type subscriptionsPage struct {
+	Items  []subscriptionResponse `json:"items"`
+	Total  int                    `json:"total"`
+	Limit  int                    `json:"limit"`
+	Offset int                    `json:"offset"`
+}
+
+// deletePreview answers a bulk delete run with dry_run=true: the
+// subscriptions that would be deleted and their number.
+type deletePreview struct {
+	WouldDelete   int                    `json:"would_delete"`
+	Subscriptions []subscriptionResponse `json:"subscriptions"`
+}
+
+// newSubscriptionsResponse builds the responses for a list of subscriptions.
+func newSubscriptionsResponse(subs []entities.Subscription, opts responseOptions) []subscriptionResponse {
+	resp := make([]subscriptionResponse, 0, len(subs))
+	for _, s := range subs {
+		resp = append(resp, newSubscriptionResponse(s, opts))
+	}
+	return resp
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"task_effective_mobile/pkg/logger"
+	"testing"
+)
+
+// decodeEnvelope decodes an error response body without going through
+// ErrorResponse, so that renamed or extra members are caught.
+func decodeEnvelope(t *testing.T, rec *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != contentTypeJSON {
+		t.Errorf("Content-Type = %q, want %q", ct, contentTypeJSON)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %v", rec.Body.String(), err)
+	}
+	return body
+}
+
+func TestErrorEnvelopeShape(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		target  string
+		status  int
+		want    []any
+	}{
+		{
+			name: "writeError",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(w, r, http.StatusConflict, "already exists")
+			}),
+			status: http.StatusConflict,
+			want:   []any{map[string]any{"code": "conflict", "message": "already exists"}},
+		},
+		{
+			name: "validation error",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeJSONError(w, r, http.StatusBadRequest, codeValidation, "price must be non-negative")
+			}),
+			status: http.StatusBadRequest,
+			want:   []any{map[string]any{"code": "validation_error", "message": "price must be non-negative"}},
+		},
+		{
+			name: "invalid field",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeErrors(w, r, http.StatusUnprocessableEntity, APIError{Code: codeInvalidField, Field: "end_date", Value: "13-2025", Message: "end_date: invalid month"})
+			}),
+			status: http.StatusUnprocessableEntity,
+			want:   []any{map[string]any{"code": "invalid_field", "field": "end_date", "value": "13-2025", "message": "end_date: invalid month"}},
+		},
+		{
+			name:    "not found route",
+			handler: routeErrors(mux),
+			target:  "/missing",
+			status:  http.StatusNotFound,
+			want:    []any{map[string]any{"code": "not_found", "message": "no route for /missing"}},
+		},
+		{
+			name:    "method not allowed",
+			handler: routeErrors(mux),
+			method:  http.MethodPost,
+			target:  "/subscriptions/1",
+			status:  http.StatusMethodNotAllowed,
+			want:    []any{map[string]any{"code": "method_not_allowed", "message": "method not allowed"}},
+		},
+		{
+			name: "panic",
+			handler: recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			})),
+			status: http.StatusInternalServerError,
+			want:   []any{map[string]any{"code": "internal_error", "message": "internal server error"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, target := tt.method, tt.target
+			if method == "" {
+				method = http.MethodGet
+			}
+			if target == "" {
+				target = "/"
+			}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(method, target, nil)
+			req = req.WithContext(logger.WithLogger(req.Context(), slog.New(slog.DiscardHandler)))
+			tt.handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			want := map[string]any{"status": float64(tt.status), "errors": tt.want}
+			if got := decodeEnvelope(t, rec); !reflect.DeepEqual(got, want) {
+				t.Errorf("body = %v, want %v", got, want)
+			}
+		})
+	}
+}
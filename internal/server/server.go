@@ -9,14 +9,28 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"task_effective_mobile/api"
 	"task_effective_mobile/internal/config"
 	"task_effective_mobile/internal/repositories"
 	"task_effective_mobile/pkg/logger"
+	"task_effective_mobile/pkg/tracing"
+	"time"
+	"unicode/utf8"
+
+	httpSwagger "github.com/swaggo/http-swagger"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 // @title Subscriptions API
@@ -26,331 +40,1603 @@ import (
 // @BasePath /
 
 // @Summary Create subscription
-// @Description Create a new subscription
+// @Description Create a new subscription. service_name is stored trimmed and lowercased, and service_name filters are matched the same way. price must be between 0 and MAX_PRICE. currency is an optional ISO 4217 code (3 uppercase letters, default USD). A subscription overlapping another one of the same user to the same service is rejected with 409.
 // @Tags subscriptions
 // @Accept json
-// @Produce json
+// @Produce json,application/msgpack
 // @Param subscription body object true "Subscription to create"
+// @Param close_previous query bool false "End the user's active subscriptions to the same service at the new start date"
+// @Param Idempotency-Key header string false "Key making the request safe to retry: a repeat with the same key and request returns the original response for 24h"
 // @Success 201 {object} map[string]int
-// @Failure 400 {string} string
-// @Failure 500 {string} string
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Router /subscriptions [post]
 func createSubscriptionsDoc() {}
 
 // @Summary List subscriptions
-// @Description Get list of subscriptions
+// @Description Get a page of subscriptions as {items, total, limit, offset}. start_date/end_date select subscriptions overlapping the period (as /subscriptions/total does); with exact_period=true they must match start_date/end_date exactly instead.
 // @Tags subscriptions
-// @Produce json
-// @Success 200 {array} object
-// @Failure 500 {string} string
+// @Produce json,application/msgpack
+// @Param user_id query string false "User ID"
+// @Param service_name query string false "Service name"
+// @Param service_name_like query string false "Case-insensitive substring of the service name (at most 255 characters); combined with service_name, both must match"
+// @Param start_date query string false "Period start in MM-YYYY"
+// @Param end_date query string false "Period end in MM-YYYY"
+// @Param exact_period query bool false "Match start_date/end_date exactly instead of by overlap"
+// @Param annotate_duplicates query bool false "Add has_duplicate flag for overlapping subscriptions of the same user and service"
+// @Param billing_cycle query string false "Only subscriptions created in the given billing cycle (current)"
+// @Param active_on query string false "Only subscriptions active in the given month (MM-YYYY or another format accepted for start_date)"
+// @Param min_price query int false "Minimum price, inclusive"
+// @Param max_price query int false "Maximum price, inclusive"
+// @Param sort query string false "Sort field: id (default), price, start_date, service_name, or period_cost (price times months of overlap with start_date..end_date, requires both)"
+// @Param order query string false "Sort order: asc or desc (default asc, desc for period_cost)"
+// @Param with query string false "Comma-separated computed fields to include (period, remaining)"
+// @Param date_format query string false "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)"
+// @Param limit query int false "Page size (default 50, at most 500)"
+// @Param offset query int false "Number of subscriptions to skip (default 0)"
+// @Success 200 {object} object
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Router /subscriptions [get]
 func listSubscriptionsDoc() {}
 
-// subscriptionsHandler returns an http.HandlerFunc that handles requests to
-// the /subscriptions endpoint. It supports POST for creating a subscription
-// and GET for listing all subscriptions.
-func subscriptionsHandler(ctx context.Context, repo *repositories.SubscriptionsRepository) http.HandlerFunc {
+// createSubscriptionHandler returns an http.HandlerFunc that handles POST
+// /subscriptions, creating a subscription. cfg controls request defaults such
+// as filling in a missing start date and the status code used for validation
+// errors.
+func createSubscriptionHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log := logger.GetLogger(ctx)
-		log.Info("subscriptionsHandler:", "Received", r.Method, "request at", r.URL.Path)
-		switch r.Method {
-		case http.MethodPost:
-			defer func() { _ = r.Body.Close() }()
-			body, err := io.ReadAll(r.Body)
+		log := logger.GetLogger(r.Context())
+		log.Info("createSubscriptionHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		body, ok := readBody(w, r, cfg.MaxBodyBytes)
+		if !ok {
+			return
+		}
+		var req createSubscriptionRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid json body")
+			log.Error("createSubscriptionHandler: failed to unmarshal request body", "error", err)
+			return
+		}
+
+		if err := req.validate(cfg.CreateDefaultStart); err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("createSubscriptionHandler: invalid request", "error", err)
+			return
+		}
+
+		closePrevious := r.URL.Query().Get("close_previous") == "true"
+		create := func(repo *repositories.SubscriptionsRepository) (map[string]int, error) {
+			var id, closed int
+			var err error
+			if closePrevious {
+				id, closed, err = repo.CreateSubClosingPrevious(r.Context(), req.ServiceName, req.Price, req.Currency, req.UserID, req.StartDate, req.EndDate, req.ExternalID)
+			} else {
+				id, err = repo.CreateSub(r.Context(), req.ServiceName, req.Price, req.Currency, req.UserID, req.StartDate, req.EndDate, req.ExternalID)
+			}
 			if err != nil {
-				http.Error(w, "failed to read request body", http.StatusBadRequest)
-				log.Error("subscriptionsHandler: failed to read request body", "error", err)
+				return nil, err
+			}
+			resp := map[string]int{"id": id}
+			if closePrevious {
+				resp["closed"] = closed
+			}
+			return resp, nil
+		}
+
+		var resp map[string]int
+		var err error
+		replayed := false
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			resp, err = create(repo)
+		} else {
+			if len(key) > maxIdempotencyKeyLen {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLen))
+				log.Error("createSubscriptionHandler: idempotency key too long", "length", len(key))
+				return
+			}
+			resp, replayed, err = createIdempotent(r, repo, key, body, create)
+		}
+		if err != nil {
+			if errors.Is(err, repositories.ErrIdempotencyKeyReused) {
+				writeJSONError(w, r, http.StatusConflict, codeIdempotencyKeyReused, err.Error())
+				log.Error("createSubscriptionHandler: idempotency key reused", "error", err)
 				return
 			}
-			var req struct {
-				ServiceName string `json:"service_name"`
-				Price       int    `json:"price"`
-				UserID      string `json:"user_id"`
-				StartDate   string `json:"start_date"`
-				EndDate     string `json:"end_date"`
+			if errors.Is(err, repositories.ErrConflict) {
+				writeError(w, r, http.StatusConflict, err.Error())
+				log.Error("createSubscriptionHandler: conflicting subscription", "error", err)
+				return
 			}
-			if err := json.Unmarshal(body, &req); err != nil {
-				http.Error(w, "invalid json body", http.StatusBadRequest)
-				log.Error("subscriptionsHandler: failed to unmarshal request body", "error", err)
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("createSubscriptionHandler: invalid subscription", "error", err)
 				return
 			}
+			writeServerError(w, r, "failed to create subscription", err)
+			log.Error("createSubscriptionHandler: failed to create subscription", "error", err)
+			return
+		}
+		if replayed {
+			w.Header().Set(idempotentReplayedHeader, "true")
+		}
+		_ = writeResponse(w, r, http.StatusCreated, resp)
+		log.Info("createSubscriptionHandler: Created subscription", "id", resp["id"], "closed", resp["closed"], "replayed", replayed)
+	}
+}
 
-			if req.ServiceName == "" || req.UserID == "" || req.StartDate == "" {
-				http.Error(w, "missing required fields", http.StatusBadRequest)
-				log.Error("subscriptionsHandler: Missing required fields", "error", err)
+// listSubscriptionsHandler returns an http.HandlerFunc that handles GET
+// /subscriptions, listing a page of the subscriptions matching the filters
+// in the query string.
+func listSubscriptionsHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("listSubscriptionsHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		q := r.URL.Query()
+		opts, err := parseResponseOptions(q)
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("listSubscriptionsHandler: invalid response options", "error", err)
+			return
+		}
+		filter := repositories.SubsListFilter{
+			ExactPeriod:        q.Get("exact_period") == "true",
+			AnnotateDuplicates: q.Get("annotate_duplicates") == "true",
+		}
+		if v := q.Get("user_id"); v != "" {
+			if err := validateUserID(v); err != nil {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("listSubscriptionsHandler: invalid user_id", "user_id", v)
 				return
 			}
-			if req.Price < 0 {
-				http.Error(w, "price must be non-negative", http.StatusBadRequest)
-				log.Error("subscriptionsHandler: Price must be non-negative", req.Price)
+			filter.UserID = &v
+		}
+		if v := q.Get("service_name"); v != "" {
+			filter.ServiceName = &v
+		}
+		if v := q.Get("service_name_like"); v != "" {
+			if utf8.RuneCountInString(v) > maxServiceNameLikeLen {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, fmt.Sprintf("service_name_like must be at most %d characters", maxServiceNameLikeLen))
+				log.Error("listSubscriptionsHandler: service_name_like too long", "length", len(v))
 				return
 			}
-
-			id, err := repo.CreateSub(r.Context(), req.ServiceName, req.Price, req.UserID, req.StartDate, req.EndDate)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("failed to create subscription: %v", err), http.StatusInternalServerError)
-				log.Error("subscriptionsHandler: failed to create subscription", "error", err)
+			filter.ServiceNameLike = &v
+		}
+		if v := q.Get("start_date"); v != "" {
+			filter.StartDate = &v
+		}
+		if v := q.Get("end_date"); v != "" {
+			filter.EndDate = &v
+		}
+		switch v := q.Get("billing_cycle"); v {
+		case "":
+		case "current":
+			from, before := repositories.BillingCycle(time.Now(), cfg.BillingCycleAnchorDay)
+			filter.CreatedFrom, filter.CreatedBefore = &from, &before
+		default:
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, "invalid billing_cycle: only current is supported")
+			log.Error("listSubscriptionsHandler: invalid billing_cycle", "billing_cycle", v)
+			return
+		}
+		activeOn, err := parseMonthParam(q, "active_on", repo.ParseMonth)
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("listSubscriptionsHandler: invalid active_on", "error", err)
+			return
+		}
+		filter.ActiveOn = activeOn
+		minPrice, maxPrice, err := parsePriceRange(q)
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("listSubscriptionsHandler: invalid price range", "error", err)
+			return
+		}
+		filter.MinPrice, filter.MaxPrice = minPrice, maxPrice
+		filter.SortBy = q.Get("sort")
+		filter.SortOrder = q.Get("order")
+		if filter.Limit, filter.Offset, err = parsePage(q); err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("listSubscriptionsHandler: invalid page", "error", err)
+			return
+		}
+		subs, total, err := repo.GetSubsList(r.Context(), filter)
+		if err != nil {
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("listSubscriptionsHandler: bad request", "error", err)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusCreated)
-			_ = json.NewEncoder(w).Encode(map[string]int{"id": id})
-			log.Info("subscriptionsHandler: Created subscription", "id", id)
+			writeServerError(w, r, "failed to get subscriptions", err)
+			log.Error("listSubscriptionsHandler: failed to get subscriptions", "error", err)
+			return
+		}
+		page := subscriptionsPage{
+			Items:  newSubscriptionsResponse(subs, opts),
+			Total:  total,
+			Limit:  filter.Limit,
+			Offset: filter.Offset,
+		}
+		if err := writeResponse(w, r, http.StatusOK, page); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+			log.Error("listSubscriptionsHandler: failed to encode subscriptions response", "error", err)
+			return
+		}
+		log.Info("listSubscriptionsHandler: Returned subscriptions list", "count", len(subs), "total", total)
+	}
+}
 
-		case http.MethodGet:
-			subs, err := repo.GetSubsList(r.Context())
-			if err != nil {
-				http.Error(w, fmt.Sprintf("failed to get subscriptions: %v", err), http.StatusInternalServerError)
-				log.Error("subscriptionsHandler: failed to get subscriptions", "error", err)
+// @Summary List subscriptions of a user
+// @Description List a page of the subscriptions of one user, ordered by id
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param user_id path string true "User ID"
+// @Param limit query int false "Page size (default 50, at most 500)"
+// @Param offset query int false "Number of subscriptions to skip (default 0)"
+// @Param with query string false "Comma-separated computed fields to include (period, remaining)"
+// @Param date_format query string false "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)"
+// @Success 200 {object} subscriptionsPage
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /users/{user_id}/subscriptions [get]
+func userSubscriptionsDoc() {}
+
+// userSubscriptionsHandler returns an http.HandlerFunc that handles GET
+// /users/{user_id}/subscriptions, listing a page of the subscriptions of
+// one user.
+func userSubscriptionsHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("userSubscriptionsHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		userID := r.PathValue("user_id")
+		if err := validateUserID(userID); err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("userSubscriptionsHandler: invalid user_id", "user_id", userID)
+			return
+		}
+		q := r.URL.Query()
+		opts, err := parseResponseOptions(q)
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("userSubscriptionsHandler: invalid response options", "error", err)
+			return
+		}
+		limit, offset, err := parsePage(q)
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("userSubscriptionsHandler: invalid page", "error", err)
+			return
+		}
+
+		subs, total, err := repo.GetSubsByUser(r.Context(), userID, limit, offset)
+		if err != nil {
+			writeServerError(w, r, "failed to get subscriptions", err)
+			log.Error("userSubscriptionsHandler: failed to get subscriptions", "user_id", userID, "error", err)
+			return
+		}
+		page := subscriptionsPage{
+			Items:  newSubscriptionsResponse(subs, opts),
+			Total:  total,
+			Limit:  limit,
+			Offset: offset,
+		}
+		if err := writeResponse(w, r, http.StatusOK, page); err != nil {
+			log.Error("userSubscriptionsHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("userSubscriptionsHandler: Returned subscriptions", "user_id", userID, "count", len(subs), "total", total)
+	}
+}
+
+// @Summary Create subscriptions in bulk
+// @Description Create all subscriptions of a JSON array in one transaction. Each element follows the rules of single create; if any element is rejected nothing is created and the errors name the offending index in their field, e.g. "[3]" or "[3].end_date".
+// @Tags subscriptions
+// @Accept json
+// @Produce json,application/msgpack
+// @Param subscriptions body []object true "Subscriptions to create"
+// @Success 201 {object} map[string][]int
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/batch [post]
+func createSubscriptionsBatchDoc() {}
+
+// maxBatchSize is the largest number of subscriptions accepted by a single
+// batch create request.
+const maxBatchSize = 1000
+
+// subscriptionsBatchHandler returns an http.HandlerFunc that handles POST
+// for the /subscriptions/batch endpoint, creating an array of subscriptions
+// all or nothing. Every element is validated up front and all invalid ones
+// are reported together; a failure while inserting reports the first
+// failing element. Error fields carry the element index.
+func subscriptionsBatchHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionsBatchHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		defer func() { _ = r.Body.Close() }()
+		var reqs []createSubscriptionRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)).Decode(&reqs); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+				log.Error("subscriptionsBatchHandler: request body too large", "limit", tooLarge.Limit)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			if err := json.NewEncoder(w).Encode(subs); err != nil {
-				http.Error(w, "failed to encode response", http.StatusInternalServerError)
-				log.Error("subscriptionsHandler: failed to encode subscriptions response", "error", err)
-				return
+			writeError(w, r, http.StatusBadRequest, "invalid json body: expected an array of subscriptions")
+			log.Error("subscriptionsBatchHandler: failed to decode request body", "error", err)
+			return
+		}
+		if len(reqs) == 0 || len(reqs) > maxBatchSize {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, fmt.Sprintf("batch must contain between 1 and %d subscriptions", maxBatchSize))
+			log.Error("subscriptionsBatchHandler: invalid batch size", "size", len(reqs))
+			return
+		}
+
+		var invalid []APIError
+		subs := make([]repositories.NewSub, 0, len(reqs))
+		for i := range reqs {
+			req := &reqs[i]
+			if err := req.validate(cfg.CreateDefaultStart); err != nil {
+				invalid = append(invalid, APIError{Code: codeValidation, Field: fmt.Sprintf("[%d]", i), Message: err.Error()})
+				continue
 			}
-			log.Info("subscriptionsHandler: Returned subscriptions list", "count", len(subs))
+			subs = append(subs, repositories.NewSub{ServiceName: req.ServiceName, Price: req.Price, Currency: req.Currency, UserID: req.UserID, StartDate: req.StartDate, EndDate: req.EndDate, ExternalID: req.ExternalID})
+		}
+		if len(invalid) > 0 {
+			writeErrors(w, r, cfg.ValidationStatusCode, invalid...)
+			log.Error("subscriptionsBatchHandler: invalid subscriptions", "count", len(invalid))
+			return
+		}
 
-		default:
-			w.Header().Set("Allow", "GET, POST")
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			log.Error("subscriptionsHandler: Unsupported method", r.Method)
+		ids, err := repo.CreateSubsBatch(r.Context(), subs)
+		if err != nil {
+			var itemErr *repositories.BatchItemError
+			if !errors.As(err, &itemErr) {
+				writeServerError(w, r, "failed to create subscriptions", err)
+				log.Error("subscriptionsBatchHandler: failed to create subscriptions", "error", err)
+				return
+			}
+			field := fmt.Sprintf("[%d]", itemErr.Index)
+			msg := itemErr.Err.Error()
+			var fieldErr *repositories.FieldError
+			switch {
+			case errors.As(itemErr.Err, &fieldErr):
+				writeErrors(w, r, cfg.ValidationStatusCode, APIError{Code: codeInvalidField, Field: field + "." + fieldErr.Field, Value: fieldErr.Value, Message: fieldErr.Error()})
+			case errors.Is(itemErr.Err, repositories.ErrConflict):
+				writeErrors(w, r, http.StatusConflict, APIError{Code: codeConflict, Field: field, Message: msg})
+			case errors.Is(itemErr.Err, repositories.ErrValidation):
+				writeErrors(w, r, cfg.ValidationStatusCode, APIError{Code: codeValidation, Field: field, Message: msg})
+			default:
+				writeServerError(w, r, "failed to create subscriptions", err)
+			}
+			log.Error("subscriptionsBatchHandler: batch rejected", "index", itemErr.Index, "error", err)
+			return
 		}
+		_ = writeResponse(w, r, http.StatusCreated, map[string][]int{"ids": ids})
+		log.Info("subscriptionsBatchHandler: Created subscriptions", "count", len(ids))
 	}
 }
 
 // @Summary Get subscription by id
 // @Description Get subscription by id
 // @Tags subscriptions
-// @Produce json
+// @Produce json,application/msgpack
 // @Param id path int true "Subscription ID"
+// @Param with query string false "Comma-separated computed fields to include (period, remaining)"
+// @Param date_format query string false "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)"
 // @Success 200 {object} object
-// @Failure 400 {string} string
-// @Failure 404 {string} string
-// @Failure 500 {string} string
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Router /subscriptions/{id} [get]
 func getSubscriptionsDoc() {}
 
 // @Summary Update subscription by id
-// @Description Update subscription fields partially
+// @Description Update subscription fields partially. PATCH and PUT are equivalent: PUT is kept for existing clients and is a partial update too, not a full replacement. With Content-Type application/merge-patch+json the body is an RFC 7386 merge patch: absent fields are unchanged and null clears a field (only end_date can be cleared). The update must name the subscription version it is based on, either in the If-Match header (the ETag returned by GET) or in the version field; the request is rejected with 409 when the subscription has been modified since, and with 428 when no version is given. The new version is returned in the ETag header. An invalid start_date or end_date is reported with the validation status and an error with code invalid_field naming the field and echoing the value.
 // @Tags subscriptions
-// @Accept json
+// @Accept json,application/merge-patch+json
 // @Param id path int true "Subscription ID"
+// @Param If-Match header string false "ETag of the version the update is based on, e.g. \"1\"; required unless the body has a version field"
 // @Param subscription body object true "Fields to update"
 // @Success 204 {string} string
-// @Failure 400 {string} string
-// @Failure 404 {string} string
-// @Failure 500 {string} string
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 428 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/{id} [patch]
 // @Router /subscriptions/{id} [put]
 func updateSubscriptionsDoc() {}
 
 // @Summary Delete subscription by id
-// @Description Delete subscription
+// @Description Soft-delete subscription: it is kept for audits but no longer returned or counted, and can be brought back with the restore endpoint. With dry_run=true nothing is deleted and the subscription that would be deleted is returned with 200.
 // @Tags subscriptions
+// @Produce json,application/msgpack
 // @Param id path int true "Subscription ID"
+// @Param dry_run query bool false "Preview the deletion without deleting"
+// @Success 200 {object} object
 // @Success 204 {string} string
-// @Failure 404 {string} string
-// @Failure 500 {string} string
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Router /subscriptions/{id} [delete]
 func deleteSubscriptionsDoc() {}
 
+// @Summary Delete all subscriptions of a user
+// @Description Soft-delete every subscription of the user, e.g. when offboarding them; each can be brought back with the restore endpoint. With dry_run=true nothing is deleted and the answer lists the subscriptions that would be deleted, as {"would_delete": N, "subscriptions": [...]}.
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param user_id query string true "User ID"
+// @Param dry_run query bool false "Preview the deletion without deleting"
+// @Success 200 {object} map[string]int
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions [delete]
+func deleteUserSubscriptionsDoc() {}
+
 // @Summary Get total cost
-// @Description Calculate total sum of subscription prices for the given filters and period (optional filters: user_id, service_name, start_date, end_date in MM-YYYY)
+// @Description Calculate the total cost of subscriptions for the given filters and period. With both start_date and end_date each subscription counts price x months active within the period; otherwise raw prices are summed (optional filters: user_id, repeated or comma-separated to sum the subscriptions of several users, service_name, has_service_name, start_date, end_date in MM-YYYY, exclude_service repeated for each service to leave out, currency, filter[column]=value for equality on user_id, service_name, status, currency, external_id or price). An absent or empty service_name applies no service filter; use has_service_name=false to select subscriptions whose service name is empty. Prices in different currencies are not added up: when the matching subscriptions use several currencies the request is rejected and currency must be given.
 // @Tags subscriptions
-// @Produce json
-// @Param user_id query string false "User ID"
+// @Produce json,application/msgpack
+// @Param user_id query []string false "User IDs, repeated or comma-separated; subscriptions of any of them are summed" collectionFormat(multi)
 // @Param service_name query string false "Service name"
+// @Param has_service_name query bool false "true: only subscriptions with a service name; false: only those with an empty one"
+// @Param currency query string false "Only subscriptions priced in this ISO 4217 currency"
 // @Param start_date query string false "Period start in MM-YYYY"
 // @Param end_date query string false "Period end in MM-YYYY"
+// @Param exclude_service query []string false "Service names to exclude" collectionFormat(multi)
+// @Param min_price query int false "Minimum price, inclusive"
+// @Param max_price query int false "Maximum price, inclusive"
+// @Param filter[column] query string false "Equality filter on a whitelisted column, e.g. filter[status]=active"
 // @Success 200 {object} map[string]int
-// @Failure 400 {string} string
-// @Failure 500 {string} string
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Router /subscriptions/total [get]
 func subscriptionsTotalDoc() {}
 
-func subscriptionsTotalHandler(ctx context.Context, repo *repositories.SubscriptionsRepository) http.HandlerFunc {
+// subscriptionsTotalHandler returns an http.HandlerFunc that handles GET for
+// the /subscriptions/total endpoint, summing subscription prices for the
+// filters given in the query string. Every computed total is logged as a
+// total_cost_computed event for auditing.
+func subscriptionsTotalHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log := logger.GetLogger(ctx)
-		log.Info("subscriptionsTotalHandler: Received", r.Method, "request at", r.URL.Path)
-		if r.Method != http.MethodGet {
-			w.Header().Set("Allow", "GET")
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			log.Error("subscriptionsTotalHandler: Unsupported method", r.Method)
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionsTotalHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		filter, err := parseTotalCostFilter(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("subscriptionsTotalHandler: invalid filter", "error", err)
 			return
 		}
 
+		total, err := repo.GetTotalCost(r.Context(), filter)
+		if err != nil {
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("subscriptionsTotalHandler: bad request", "error", err)
+				return
+			}
+			writeServerError(w, r, "failed to calculate total", err)
+			log.Error("subscriptionsTotalHandler: failed to calculate total", "error", err)
+			return
+		}
+		log.Info(totalCostComputedEvent, append(totalCostAuditAttrs(filter), "total", total)...)
+
+		if err := writeResponse(w, r, http.StatusOK, map[string]int{"total": total}); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+			log.Error("subscriptionsTotalHandler: failed to encode response", "error", err)
+			return
+		}
+	}
+}
+
+// totalCostComputedEvent is the stable message of the audit log event
+// recording each total cost answered by subscriptionsTotalHandler.
+const totalCostComputedEvent = "total_cost_computed"
+
+// totalCostAuditAttrs returns every filter of a total cost query as
+// attributes of the total_cost_computed event, so that two different totals
+// never produce the same audit line. Filters that are not applied are logged
+// as "all" so that they cannot be mistaken for an empty value.
+func totalCostAuditAttrs(filter repositories.TotalCostFilter) []any {
+	orAll := func(v *string) string {
+		if v == nil {
+			return "all"
+		}
+		return *v
+	}
+	joinOrAll := func(values []string) string {
+		if len(values) == 0 {
+			return "all"
+		}
+		return strings.Join(values, ",")
+	}
+	intOrAll := func(v *int) string {
+		if v == nil {
+			return "all"
+		}
+		return strconv.Itoa(*v)
+	}
+	hasServiceName := "all"
+	if filter.HasServiceName != nil {
+		hasServiceName = strconv.FormatBool(*filter.HasServiceName)
+	}
+	var fields any = "all"
+	if len(filter.Fields) > 0 {
+		columns := make([]string, 0, len(filter.Fields))
+		for column := range filter.Fields {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		attrs := make([]slog.Attr, 0, len(columns))
+		for _, column := range columns {
+			attrs = append(attrs, slog.String(column, filter.Fields[column]))
+		}
+		fields = slog.GroupValue(attrs...)
+	}
+	return []any{
+		"user_id", joinOrAll(filter.UserIDs),
+		"service_name", orAll(filter.ServiceName),
+		"has_service_name", hasServiceName,
+		"exclude_service", joinOrAll(filter.ExcludeServices),
+		"currency", orAll(filter.Currency),
+		slog.Group("price", "min", intOrAll(filter.MinPrice), "max", intOrAll(filter.MaxPrice)),
+		slog.Group("period", "start", orAll(filter.StartDate), "end", orAll(filter.EndDate)),
+		"filter", fields,
+	}
+}
+
+// @Summary Get total cost by service
+// @Description Total cost per service_name and currency, ordered by service name and currency, for the same filters and proration rules as /subscriptions/total
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param user_id query []string false "User IDs, repeated or comma-separated" collectionFormat(multi)
+// @Param service_name query string false "Service name"
+// @Param has_service_name query bool false "true: only subscriptions with a service name; false: only those with an empty one"
+// @Param currency query string false "Only subscriptions priced in this ISO 4217 currency"
+// @Param start_date query string false "Period start in MM-YYYY"
+// @Param end_date query string false "Period end in MM-YYYY"
+// @Param exclude_service query []string false "Service names to exclude" collectionFormat(multi)
+// @Param min_price query int false "Minimum price, inclusive"
+// @Param max_price query int false "Maximum price, inclusive"
+// @Param filter[column] query string false "Equality filter on a whitelisted column, e.g. filter[status]=active"
+// @Success 200 {array} repositories.ServiceTotal
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/total/breakdown [get]
+func subscriptionsTotalBreakdownDoc() {}
+
+// subscriptionsTotalBreakdownHandler returns an http.HandlerFunc that handles
+// GET for the /subscriptions/total/breakdown endpoint, splitting the total
+// cost across services.
+func subscriptionsTotalBreakdownHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionsTotalBreakdownHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		filter, err := parseTotalCostFilter(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("subscriptionsTotalBreakdownHandler: invalid filter", "error", err)
+			return
+		}
+
+		breakdown, err := repo.GetCostByService(r.Context(), filter)
+		if err != nil {
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("subscriptionsTotalBreakdownHandler: bad request", "error", err)
+				return
+			}
+			writeServerError(w, r, "failed to calculate breakdown", err)
+			log.Error("subscriptionsTotalBreakdownHandler: failed to calculate breakdown", "error", err)
+			return
+		}
+		if err := writeResponse(w, r, http.StatusOK, breakdown); err != nil {
+			log.Error("subscriptionsTotalBreakdownHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("subscriptionsTotalBreakdownHandler: Returned breakdown", "services", len(breakdown))
+	}
+}
+
+// @Summary Get monthly total cost time series
+// @Description Total cost of the subscriptions active in each month from start_date to end_date, both required and inclusive, in chronological order; months without subscriptions have a total of 0. The period must not be inverted nor span more than MAX_MONTHS months. The other filters are those of /subscriptions/total, and so is the currency rule.
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param start_date query string true "First month in MM-YYYY"
+// @Param end_date query string true "Last month in MM-YYYY"
+// @Param user_id query []string false "User IDs, repeated or comma-separated" collectionFormat(multi)
+// @Param service_name query string false "Service name"
+// @Param has_service_name query bool false "true: only subscriptions with a service name; false: only those with an empty one"
+// @Param currency query string false "Only subscriptions priced in this ISO 4217 currency"
+// @Param exclude_service query []string false "Service names to exclude" collectionFormat(multi)
+// @Param min_price query int false "Minimum price, inclusive"
+// @Param max_price query int false "Maximum price, inclusive"
+// @Param filter[column] query string false "Equality filter on a whitelisted column, e.g. filter[status]=active"
+// @Success 200 {array} repositories.MonthTotal
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/total/timeseries [get]
+func subscriptionsTotalTimeseriesDoc() {}
+
+// subscriptionsTotalTimeseriesHandler returns an http.HandlerFunc that
+// handles GET for the /subscriptions/total/timeseries endpoint, returning
+// the total cost of each month of the requested period for charting.
+func subscriptionsTotalTimeseriesHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionsTotalTimeseriesHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		filter, err := parseTotalCostFilter(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("subscriptionsTotalTimeseriesHandler: invalid filter", "error", err)
+			return
+		}
+		if filter.StartDate == nil || filter.EndDate == nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, "missing required start_date and end_date")
+			log.Error("subscriptionsTotalTimeseriesHandler: missing period")
+			return
+		}
+
+		series, err := repo.GetCostTimeseries(r.Context(), filter, cfg.MaxMonths)
+		if err != nil {
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("subscriptionsTotalTimeseriesHandler: bad request", "error", err)
+				return
+			}
+			writeServerError(w, r, "failed to calculate timeseries", err)
+			log.Error("subscriptionsTotalTimeseriesHandler: failed to calculate timeseries", "error", err)
+			return
+		}
+		if err := writeResponse(w, r, http.StatusOK, series); err != nil {
+			log.Error("subscriptionsTotalTimeseriesHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("subscriptionsTotalTimeseriesHandler: Returned timeseries", "months", len(series))
+	}
+}
+
+// defaultTrendMonths is the number of months returned by the trend endpoint
+// when the months parameter is omitted (or MAX_MONTHS, if lower).
+const defaultTrendMonths = 12
+
+// @Summary Get monthly cost trend
+// @Description Total cost of active subscriptions for each of the last N months (including the current one), in chronological order. Prices in different currencies are not added up: when the subscriptions active in the window use several currencies the request is rejected and currency must be given.
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param months query int false "Number of months (default 12, at most MAX_MONTHS)"
+// @Param currency query string false "Only subscriptions priced in this ISO 4217 currency"
+// @Success 200 {array} repositories.MonthTotal
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/trend [get]
+func subscriptionsTrendDoc() {}
+
+// subscriptionsTrendHandler returns an http.HandlerFunc that handles GET for
+// the /subscriptions/trend endpoint, returning the monthly cost of active
+// subscriptions over a rolling window ending with the current month.
+func subscriptionsTrendHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionsTrendHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		months := min(defaultTrendMonths, cfg.MaxMonths)
+		if v := r.URL.Query().Get("months"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, "months must be a positive integer")
+				log.Error("subscriptionsTrendHandler: invalid months", "months", v)
+				return
+			}
+			if n > cfg.MaxMonths {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, fmt.Sprintf("months must not exceed %d", cfg.MaxMonths))
+				log.Error("subscriptionsTrendHandler: months exceeds maximum", "months", n, "max", cfg.MaxMonths)
+				return
+			}
+			months = n
+		}
+		var currency *string
+		if v := r.URL.Query().Get("currency"); v != "" {
+			currency = &v
+		}
+
+		trend, err := repo.GetTrend(r.Context(), months, currency)
+		if err != nil {
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("subscriptionsTrendHandler: bad request", "error", err)
+				return
+			}
+			writeServerError(w, r, "failed to get trend", err)
+			log.Error("subscriptionsTrendHandler: failed to get trend", "error", err)
+			return
+		}
+		if err := writeResponse(w, r, http.StatusOK, trend); err != nil {
+			log.Error("subscriptionsTrendHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("subscriptionsTrendHandler: Returned trend", "months", months)
+	}
+}
+
+// @Summary Count subscriptions
+// @Description Number of subscriptions matching the filters, without transferring the rows
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param user_id query string false "User ID"
+// @Param service_name query string false "Service name"
+// @Success 200 {object} map[string]int
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/count [get]
+func subscriptionsCountDoc() {}
+
+// subscriptionsCountHandler returns an http.HandlerFunc that handles GET for
+// the /subscriptions/count endpoint, answering with the number of
+// subscriptions matching the user_id and service_name filters.
+func subscriptionsCountHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionsCountHandler: Received request", "method", r.Method, "path", r.URL.Path)
 		q := r.URL.Query()
-		var userIDPtr *string
+		var filter repositories.SubsListFilter
 		if v := q.Get("user_id"); v != "" {
-			userIDPtr = &v
+			if err := validateUserID(v); err != nil {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("subscriptionsCountHandler: invalid user_id", "user_id", v)
+				return
+			}
+			filter.UserID = &v
 		}
-		var serviceNamePtr *string
 		if v := q.Get("service_name"); v != "" {
-			serviceNamePtr = &v
+			filter.ServiceName = &v
 		}
-		var startPtr *string
-		if v := q.Get("start_date"); v != "" {
-			startPtr = &v
+
+		count, err := repo.CountSubs(r.Context(), filter)
+		if err != nil {
+			writeServerError(w, r, "failed to count subscriptions", err)
+			log.Error("subscriptionsCountHandler: failed to count subscriptions", "error", err)
+			return
 		}
-		var endPtr *string
-		if v := q.Get("end_date"); v != "" {
-			endPtr = &v
+		if err := writeResponse(w, r, http.StatusOK, map[string]int{"count": count}); err != nil {
+			log.Error("subscriptionsCountHandler: failed to encode response", "error", err)
+			return
 		}
+		log.Info("subscriptionsCountHandler: Returned count", "count", count)
+	}
+}
+
+// @Summary List expiring subscriptions
+// @Description Subscriptions whose end_date falls within the next N months, counting from the current month, ordered by end_date. Open-ended subscriptions are never listed.
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param within query int false "Number of months (default 1, at most MAX_MONTHS)"
+// @Param with query string false "Comma-separated computed fields to include (period, remaining)"
+// @Param date_format query string false "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)"
+// @Success 200 {array} object
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/expiring [get]
+func subscriptionsExpiringDoc() {}
 
-		total, err := repo.GetTotalCost(r.Context(), userIDPtr, serviceNamePtr, startPtr, endPtr)
+// subscriptionsExpiringHandler returns an http.HandlerFunc that handles GET
+// for the /subscriptions/expiring endpoint, listing the subscriptions that
+// end within the number of months given by within (1 when omitted).
+func subscriptionsExpiringHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionsExpiringHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		opts, err := parseResponseOptions(r.URL.Query())
 		if err != nil {
-			if strings.Contains(err.Error(), "invalid") || strings.Contains(err.Error(), "cannot be empty") {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				log.Error("subscriptionsTotalHandler: bad request", "error", err)
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("subscriptionsExpiringHandler: invalid response options", "error", err)
+			return
+		}
+		within := 1
+		if v := r.URL.Query().Get("within"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, "within must be a positive integer")
+				log.Error("subscriptionsExpiringHandler: invalid within", "within", v)
 				return
 			}
-			http.Error(w, fmt.Sprintf("failed to calculate total: %v", err), http.StatusInternalServerError)
-			log.Error("subscriptionsTotalHandler: failed to calculate total", "error", err)
+			if n > cfg.MaxMonths {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, fmt.Sprintf("within must not exceed %d", cfg.MaxMonths))
+				log.Error("subscriptionsExpiringHandler: within exceeds maximum", "within", n, "max", cfg.MaxMonths)
+				return
+			}
+			within = n
+		}
+
+		subs, err := repo.GetExpiring(r.Context(), within)
+		if err != nil {
+			writeServerError(w, r, "failed to get expiring subscriptions", err)
+			log.Error("subscriptionsExpiringHandler: failed to get expiring subscriptions", "error", err)
 			return
 		}
+		if err := writeResponse(w, r, http.StatusOK, newSubscriptionsResponse(subs, opts)); err != nil {
+			log.Error("subscriptionsExpiringHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("subscriptionsExpiringHandler: Returned expiring subscriptions", "within", within, "count", len(subs))
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(map[string]int{"total": total}); err != nil {
-			http.Error(w, "failed to encode response", http.StatusInternalServerError)
-			log.Error("subscriptionsTotalHandler: failed to encode response", "error", err)
+// @Summary Check for an active subscription
+// @Description Report whether the user has any subscription active in the given month
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param user_id query string true "User ID"
+// @Param as_of query string false "Month in MM-YYYY (default current UTC month)"
+// @Success 200 {object} map[string]bool
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/has-active [get]
+func subscriptionsHasActiveDoc() {}
+
+// subscriptionsHasActiveHandler returns an http.HandlerFunc that handles GET
+// for the /subscriptions/has-active endpoint, a cheap yes/no check of whether
+// a user has an active subscription in the month given by as_of (the current
+// month when omitted).
+func subscriptionsHasActiveHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionsHasActiveHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		q := r.URL.Query()
+		userID := q.Get("user_id")
+		if userID == "" {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, "missing required user_id")
+			log.Error("subscriptionsHasActiveHandler: missing user_id")
+			return
+		}
+		if err := validateUserID(userID); err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("subscriptionsHasActiveHandler: invalid user_id", "user_id", userID)
+			return
+		}
+		asOf := q.Get("as_of")
+		if asOf == "" {
+			asOf = currentMonth()
+		}
+
+		active, err := repo.HasActiveSub(r.Context(), userID, asOf)
+		if err != nil {
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("subscriptionsHasActiveHandler: bad request", "error", err)
+				return
+			}
+			writeServerError(w, r, "failed to check active subscriptions", err)
+			log.Error("subscriptionsHasActiveHandler: failed to check active subscriptions", "error", err)
 			return
 		}
-		log.Info("subscriptionsTotalHandler: Returned total", "total", total)
+		if err := writeResponse(w, r, http.StatusOK, map[string]bool{"active": active}); err != nil {
+			log.Error("subscriptionsHasActiveHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("subscriptionsHasActiveHandler: Returned active flag", "user_id", userID, "as_of", asOf, "active", active)
 	}
 }
 
-// subscriptionsIDHandler returns an http.HandlerFunc that handles GET, PUT
-// and DELETE for the /subscriptions/{id} endpoint. It supports retrieving
-// a single subscription, performing partial updates, and deleting the
-// subscription by id.
-func subscriptionsIDHandler(ctx context.Context, repo *repositories.SubscriptionsRepository) http.HandlerFunc {
+// getSubscriptionHandler returns an http.HandlerFunc that handles GET
+// /subscriptions/{id}, returning a single subscription with its version in
+// the ETag header.
+func getSubscriptionHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log := logger.GetLogger(ctx)
-		log.Info("subscriptionsIDHandler: Received ", r.Method, " request at ", r.URL.Path)
-		idPart := strings.TrimPrefix(r.URL.Path, "/subscriptions/")
-		idPart = strings.Trim(idPart, "/")
-		if idPart == "" {
-			http.Error(w, "missing id in path", http.StatusBadRequest)
-			log.Error("subscriptionsIDHandler: Missing id in path", "path", r.URL.Path)
+		log := logger.GetLogger(r.Context())
+		log.Info("getSubscriptionHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		id, ok := pathSubscriptionID(w, r)
+		if !ok {
 			return
 		}
-		id, err := strconv.Atoi(idPart)
+		opts, err := parseResponseOptions(r.URL.Query())
 		if err != nil {
-			http.Error(w, "invalid id", http.StatusBadRequest)
-			log.Error("subscriptionsIDHandler: Invalid id in path", "path", r.URL.Path)
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("getSubscriptionHandler: invalid response options", "error", err)
 			return
 		}
 
-		switch r.Method {
-		case http.MethodGet:
+		sub, err := repo.GetSub(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, repositories.ErrNotFound) {
+				writeError(w, r, http.StatusNotFound, "not found")
+				log.Error("getSubscriptionHandler: Not Found", "id", id)
+				return
+			}
+			writeServerError(w, r, "failed to get subscription", err)
+			log.Error("getSubscriptionHandler: Failed to get subscription", "id", id)
+			return
+		}
+		w.Header().Set("ETag", etag(sub.Version))
+		_ = writeResponse(w, r, http.StatusOK, newSubscriptionResponse(*sub, opts))
+		log.Info("getSubscriptionHandler: Get subscription", "id", id)
+	}
+}
+
+// updateSubscriptionHandler returns an http.HandlerFunc that handles PATCH
+// and PUT /subscriptions/{id}, partially updating a subscription from a
+// plain JSON body or a JSON Merge Patch. Both methods share this handler:
+// PUT predates PATCH and keeps its partial semantics for existing clients.
+// The version the update is based on comes from If-Match or the body (see
+// updateVersion); a missing version is answered with 428 and a stale one
+// with 409. Validation errors are answered with cfg.ValidationStatusCode.
+func updateSubscriptionHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("updateSubscriptionHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		id, ok := pathSubscriptionID(w, r)
+		if !ok {
+			return
+		}
+
+		body, ok := readBody(w, r, cfg.MaxBodyBytes)
+		if !ok {
+			return
+		}
+		var req updateSubscriptionRequest
+		if isMergePatch(r) {
+			var patch map[string]json.RawMessage
+			if err := json.Unmarshal(body, &patch); err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid json merge patch body")
+				log.Error("updateSubscriptionHandler: Failed to unmarshal merge patch", "error", err)
+				return
+			}
+			if err := req.applyMergePatch(patch); err != nil {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("updateSubscriptionHandler: Invalid merge patch", "error", err)
+				return
+			}
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid json body")
+			log.Error("updateSubscriptionHandler: Failed to unmarshal request body", "error", err)
+			return
+		}
+
+		if req.UserID != nil {
+			if err := validateUserID(*req.UserID); err != nil {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("updateSubscriptionHandler: invalid user_id", "user_id", *req.UserID)
+				return
+			}
+		}
+		if req.Price != nil && *req.Price < 0 {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, "price must be non-negative")
+			log.Error("updateSubscriptionHandler: Price must be non-negative", "price", req.Price)
+			return
+		}
+
+		version, err := updateVersion(r, req.Version)
+		if errors.Is(err, errVersionRequired) {
+			writeError(w, r, http.StatusPreconditionRequired, err.Error())
+			log.Error("updateSubscriptionHandler: Missing version", "id", id)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("updateSubscriptionHandler: Invalid version", "id", id, "error", err)
+			return
+		}
+
+		newVersion, err := repo.UpdateSub(r.Context(), id, version, req.ServiceName, req.Price, req.Currency, req.UserID, req.StartDate, req.EndDate, req.ExternalID)
+		if err != nil {
+			var fieldErr *repositories.FieldError
+			if errors.As(err, &fieldErr) {
+				writeErrors(w, r, cfg.ValidationStatusCode, APIError{Code: codeInvalidField, Field: fieldErr.Field, Value: fieldErr.Value, Message: fieldErr.Error()})
+				log.Error("updateSubscriptionHandler: Invalid field", "id", id, "field", fieldErr.Field, "value", fieldErr.Value)
+				return
+			}
+			if errors.Is(err, repositories.ErrConflict) {
+				writeError(w, r, http.StatusConflict, err.Error())
+				log.Error("updateSubscriptionHandler: Conflicting update", "id", id, "error", err)
+				return
+			}
+			if errors.Is(err, repositories.ErrNotFound) {
+				writeError(w, r, http.StatusNotFound, "not found")
+				log.Error("updateSubscriptionHandler: Not Found", "id", id)
+				return
+			}
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("updateSubscriptionHandler: Failed to update subscription", "id", id)
+				return
+			}
+			writeServerError(w, r, "failed to update subscription", err)
+			log.Error("updateSubscriptionHandler: Failed to update subscription", "id", id)
+			return
+		}
+		w.Header().Set("ETag", etag(newVersion))
+		w.WriteHeader(http.StatusNoContent)
+		log.Info("updateSubscriptionHandler: Updated subscription", "id", id, "version", newVersion)
+	}
+}
+
+// deleteSubscriptionHandler returns an http.HandlerFunc that handles DELETE
+// /subscriptions/{id}, soft-deleting a subscription. With dry_run=true the
+// subscription is only looked up and returned.
+func deleteSubscriptionHandler(repo *repositories.SubscriptionsRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("deleteSubscriptionHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		id, ok := pathSubscriptionID(w, r)
+		if !ok {
+			return
+		}
+
+		if r.URL.Query().Get("dry_run") == "true" {
 			sub, err := repo.GetSub(r.Context(), id)
 			if err != nil {
-				if strings.Contains(err.Error(), "not found") {
-					http.Error(w, "not found", http.StatusNotFound)
-					log.Error("subscriptionsIDHandler: Not Found", "id", id)
+				if errors.Is(err, repositories.ErrNotFound) {
+					writeError(w, r, http.StatusNotFound, "not found")
+					log.Error("deleteSubscriptionHandler: Not Found", "id", id)
 					return
 				}
-				http.Error(w, fmt.Sprintf("failed to get subscription: %v", err), http.StatusInternalServerError)
-				log.Error("subscriptionsIDHandler: Failed to get subscription", "id", id)
+				writeServerError(w, r, "failed to get subscription", err)
+				log.Error("deleteSubscriptionHandler: Failed to get subscription", "id", id, "error", err)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(sub)
-			log.Info("subscriptionsIDHandler: Get subscription", "id", id)
+			_ = writeResponse(w, r, http.StatusOK, newSubscriptionResponse(*sub, responseOptions{}))
+			log.Info("deleteSubscriptionHandler: Dry run, subscription not deleted", "id", id)
+			return
+		}
+
+		if err := repo.DeleteSub(r.Context(), id); err != nil {
+			if errors.Is(err, repositories.ErrNotFound) {
+				writeError(w, r, http.StatusNotFound, "not found")
+				log.Error("deleteSubscriptionHandler: Not Found", "id", id)
+				return
+			}
+			writeServerError(w, r, "failed to delete subscription", err)
+			log.Error("deleteSubscriptionHandler: Failed to delete subscription", "id", id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		log.Info("deleteSubscriptionHandler: Deleted subscription", "id", id)
+	}
+}
+
+// deleteUserSubscriptionsHandler returns an http.HandlerFunc that handles
+// DELETE for the /subscriptions endpoint, soft-deleting all subscriptions of
+// the user given in the required user_id query parameter and answering with
+// the number of deleted subscriptions. With dry_run=true nothing is deleted:
+// the subscriptions that would be are listed instead.
+func deleteUserSubscriptionsHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("deleteUserSubscriptionsHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, "missing required user_id")
+			log.Error("deleteUserSubscriptionsHandler: missing user_id")
+			return
+		}
+		if err := validateUserID(userID); err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("deleteUserSubscriptionsHandler: invalid user_id", "user_id", userID)
+			return
+		}
 
-		case http.MethodPut:
-			defer func() { _ = r.Body.Close() }()
-			body, err := io.ReadAll(r.Body)
+		if r.URL.Query().Get("dry_run") == "true" {
+			subs, total, err := repo.GetSubsList(r.Context(), repositories.SubsListFilter{UserID: &userID})
 			if err != nil {
-				http.Error(w, "failed to read request body", http.StatusBadRequest)
-				log.Error("subscriptionsIDHandler: Failed to read request body", "error", err)
+				writeServerError(w, r, "failed to list subscriptions", err)
+				log.Error("deleteUserSubscriptionsHandler: Failed to list subscriptions", "user_id", userID, "error", err)
+				return
+			}
+			preview := deletePreview{WouldDelete: total, Subscriptions: newSubscriptionsResponse(subs, responseOptions{})}
+			if err := writeResponse(w, r, http.StatusOK, preview); err != nil {
+				log.Error("deleteUserSubscriptionsHandler: failed to encode response", "error", err)
 				return
 			}
-			var req struct {
-				ServiceName *string `json:"service_name"`
-				Price       *int    `json:"price"`
-				UserID      *string `json:"user_id"`
-				StartDate   *string `json:"start_date"`
-				EndDate     *string `json:"end_date"`
+			log.Info("deleteUserSubscriptionsHandler: Dry run, subscriptions not deleted", "user_id", userID, "would_delete", total)
+			return
+		}
+
+		deleted, err := repo.DeleteSubsByUser(r.Context(), userID)
+		if err != nil {
+			writeServerError(w, r, "failed to delete subscriptions", err)
+			log.Error("deleteUserSubscriptionsHandler: Failed to delete subscriptions", "user_id", userID, "error", err)
+			return
+		}
+		if err := writeResponse(w, r, http.StatusOK, map[string]int{"deleted": deleted}); err != nil {
+			log.Error("deleteUserSubscriptionsHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("deleteUserSubscriptionsHandler: Deleted subscriptions", "user_id", userID, "deleted", deleted)
+	}
+}
+
+// readBody reads the body of r, allowing at most limit bytes. A larger body
+// is answered with 413 Request Entity Too Large before it is read in full,
+// and a body that cannot be read with 400; in both cases ok is false.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) (body []byte, ok bool) {
+	defer func() { _ = r.Body.Close() }()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+			logger.GetLogger(r.Context()).Error("readBody: request body too large", "path", r.URL.Path, "limit", limit)
+			return nil, false
+		}
+		writeError(w, r, http.StatusBadRequest, "failed to read request body")
+		logger.GetLogger(r.Context()).Error("readBody: failed to read request body", "path", r.URL.Path, "error", err)
+		return nil, false
+	}
+	return body, true
+}
+
+// pathSubscriptionID parses the {id} path wildcard of r. When it is not an
+// integer it answers 400 and returns false.
+func pathSubscriptionID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid id")
+		logger.GetLogger(r.Context()).Error("pathSubscriptionID: Invalid id in path", "path", r.URL.Path)
+		return 0, false
+	}
+	return id, true
+}
+
+// @Summary Get subscription tenure
+// @Description Number of whole months between the subscription start and as_of (default: current month), capped at end_date; 0 for subscriptions starting after as_of
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param id path int true "Subscription ID"
+// @Param as_of query string false "Reference month in MM-YYYY (default current UTC month)"
+// @Success 200 {object} object
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/{id}/tenure [get]
+func subscriptionTenureDoc() {}
+
+// tenureResponse is the body returned by the tenure endpoint.
+type tenureResponse struct {
+	ID     int    `json:"id"`
+	AsOf   string `json:"as_of"`
+	Months int    `json:"months"`
+}
+
+// subscriptionTenureHandler returns an http.HandlerFunc that handles GET
+// /subscriptions/{id}/tenure, reporting for how many months the subscription
+// has been active as of the month given in the as_of query parameter (the
+// current month when omitted).
+//
+// It is registered for GET /subscriptions/{id}/{resource} and answers 404 for
+// any other resource, because the pattern GET /subscriptions/{id}/tenure
+// would conflict with GET /subscriptions/by-external/{externalID}: neither is
+// more specific, as both match /subscriptions/by-external/tenure, and
+// registering that path explicitly does not lift the conflict.
+func subscriptionTenureHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("subscriptionTenureHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		if r.PathValue("resource") != "tenure" {
+			writeError(w, r, http.StatusNotFound, fmt.Sprintf("no route for %s", r.URL.Path))
+			log.Error("subscriptionTenureHandler: Unknown sub-resource", "path", r.URL.Path)
+			return
+		}
+		id, ok := pathSubscriptionID(w, r)
+		if !ok {
+			return
+		}
+
+		asOf := r.URL.Query().Get("as_of")
+		if asOf == "" {
+			asOf = currentMonth()
+		}
+		months, err := repo.GetTenure(r.Context(), id, asOf)
+		if err != nil {
+			if errors.Is(err, repositories.ErrNotFound) {
+				writeError(w, r, http.StatusNotFound, "not found")
+				log.Error("subscriptionTenureHandler: Not Found", "id", id)
+				return
 			}
-			if err := json.Unmarshal(body, &req); err != nil {
-				http.Error(w, "invalid json body", http.StatusBadRequest)
-				log.Error("subscriptionsIDHandler: Failed to unmarshal request body", "error", err)
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("subscriptionTenureHandler: bad request", "id", id, "error", err)
 				return
 			}
+			writeServerError(w, r, "failed to get tenure", err)
+			log.Error("subscriptionTenureHandler: Failed to get tenure", "id", id, "error", err)
+			return
+		}
+		if err := writeResponse(w, r, http.StatusOK, tenureResponse{ID: id, AsOf: asOf, Months: months}); err != nil {
+			log.Error("subscriptionTenureHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("subscriptionTenureHandler: Returned tenure", "id", id, "months", months)
+	}
+}
 
-			if req.Price != nil && *req.Price < 0 {
-				http.Error(w, "price must be non-negative", http.StatusBadRequest)
-				log.Error("subscriptionsIDHandler: Price must be non-negative", req.Price)
+// @Summary Restore subscription by id
+// @Description Bring back a subscription removed with DELETE /subscriptions/{id}
+// @Tags subscriptions
+// @Param id path int true "Subscription ID"
+// @Success 204 {string} string
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/{id}/restore [post]
+func restoreSubscriptionDoc() {}
+
+// restoreSubscriptionHandler returns an http.HandlerFunc that handles POST
+// /subscriptions/{id}/restore, undoing a soft delete. It answers 404 when the
+// subscription does not exist or is not deleted.
+func restoreSubscriptionHandler(repo *repositories.SubscriptionsRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("restoreSubscriptionHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		id, ok := pathSubscriptionID(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.RestoreSub(r.Context(), id); err != nil {
+			if errors.Is(err, repositories.ErrNotFound) {
+				writeError(w, r, http.StatusNotFound, err.Error())
+				log.Error("restoreSubscriptionHandler: Subscription not found", "id", id)
 				return
 			}
+			writeServerError(w, r, "failed to restore subscription", err)
+			log.Error("restoreSubscriptionHandler: Failed to restore subscription", "id", id, "error", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		log.Info("restoreSubscriptionHandler: Restored subscription", "id", id)
+	}
+}
 
-			if err := repo.UpdateSub(r.Context(), id, req.ServiceName, req.Price, req.UserID, req.StartDate, req.EndDate); err != nil {
-				if strings.Contains(err.Error(), "not found") {
-					http.Error(w, "not found", http.StatusNotFound)
-					log.Error("subscriptionsIDHandler: Not Found", "id", id)
-					return
-				}
-				if strings.Contains(err.Error(), "no fields to update") || strings.Contains(err.Error(), "invalid") {
-					http.Error(w, err.Error(), http.StatusBadRequest)
-					log.Error("subscriptionsIDHandler: Failed to update subscription", "id", id)
-					return
-				}
-				http.Error(w, fmt.Sprintf("failed to update subscription: %v", err), http.StatusInternalServerError)
-				log.Error("subscriptionsIDHandler: Failed to update subscription", "id", id)
+// @Summary Get subscription by external id
+// @Description Get the subscription identified by its external billing system id
+// @Tags subscriptions
+// @Produce json,application/msgpack
+// @Param external_id path string true "External ID"
+// @Param with query string false "Comma-separated computed fields to include (period, remaining)"
+// @Param date_format query string false "Format of start_date and end_date: month (MM-YYYY, default) or iso (YYYY-MM-01)"
+// @Success 200 {object} object
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/by-external/{external_id} [get]
+func getSubscriptionByExternalIDDoc() {}
+
+// @Summary Create or update subscription by external id
+// @Description Upsert the subscription with the given external id: the body replaces its fields when it exists, otherwise a new subscription is created. Responds 201 on create and 200 on update.
+// @Tags subscriptions
+// @Accept json
+// @Produce json,application/msgpack
+// @Param external_id path string true "External subscription ID"
+// @Param subscription body object true "Subscription data (external_id may be omitted)"
+// @Success 200 {object} map[string]int
+// @Success 201 {object} map[string]int
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/by-external/{external_id} [put]
+func upsertSubscriptionByExternalIDDoc() {}
+
+// getSubscriptionByExternalIDHandler returns an http.HandlerFunc that
+// handles GET /subscriptions/by-external/{externalID}, looking up a
+// subscription by the identifier an external billing system assigned to it.
+func getSubscriptionByExternalIDHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("getSubscriptionByExternalIDHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		externalID := r.PathValue("externalID")
+		opts, err := parseResponseOptions(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("getSubscriptionByExternalIDHandler: invalid response options", "error", err)
+			return
+		}
+
+		sub, err := repo.GetSubByExternalID(r.Context(), externalID)
+		if err != nil {
+			if errors.Is(err, repositories.ErrNotFound) {
+				writeError(w, r, http.StatusNotFound, "not found")
+				log.Error("getSubscriptionByExternalIDHandler: Not Found", "external_id", externalID)
 				return
 			}
-			w.WriteHeader(http.StatusNoContent)
-			log.Info("subscriptionsIDHandler: Updated subscription", "id", id)
+			writeServerError(w, r, "failed to get subscription", err)
+			log.Error("getSubscriptionByExternalIDHandler: Failed to get subscription", "external_id", externalID, "error", err)
+			return
+		}
+		_ = writeResponse(w, r, http.StatusOK, newSubscriptionResponse(*sub, opts))
+		log.Info("getSubscriptionByExternalIDHandler: Get subscription", "external_id", externalID, "id", sub.ID)
+	}
+}
 
-		case http.MethodDelete:
-			if err := repo.DeleteSub(r.Context(), id); err != nil {
-				if strings.Contains(err.Error(), "not found") {
-					http.Error(w, "not found", http.StatusNotFound)
-					log.Error("subscriptionsIDHandler: Not Found", "id", id)
-					return
-				}
-				http.Error(w, fmt.Sprintf("failed to delete subscription: %v", err), http.StatusInternalServerError)
-				log.Error("subscriptionsIDHandler: Failed to delete subscription", "id", id)
+// upsertSubscriptionByExternalIDHandler returns an http.HandlerFunc that
+// handles PUT /subscriptions/by-external/{externalID}, creating or replacing
+// the subscription with that external identifier, which makes sync jobs
+// idempotent.
+func upsertSubscriptionByExternalIDHandler(repo *repositories.SubscriptionsRepository, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("upsertSubscriptionByExternalIDHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		externalID := r.PathValue("externalID")
+
+		body, ok := readBody(w, r, cfg.MaxBodyBytes)
+		if !ok {
+			return
+		}
+		var req createSubscriptionRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid json body")
+			log.Error("upsertSubscriptionByExternalIDHandler: failed to unmarshal request body", "error", err)
+			return
+		}
+		if req.ExternalID != "" && req.ExternalID != externalID {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, "external_id in body does not match path")
+			log.Error("upsertSubscriptionByExternalIDHandler: external_id mismatch", "path", externalID, "body", req.ExternalID)
+			return
+		}
+		if err := req.validate(cfg.CreateDefaultStart); err != nil {
+			writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+			log.Error("upsertSubscriptionByExternalIDHandler: invalid request", "error", err)
+			return
+		}
+
+		id, created, err := repo.UpsertByExternalID(r.Context(), externalID, req.ServiceName, req.Price, req.Currency, req.UserID, req.StartDate, req.EndDate)
+		if err != nil {
+			if errors.Is(err, repositories.ErrConflict) {
+				writeError(w, r, http.StatusConflict, err.Error())
+				log.Error("upsertSubscriptionByExternalIDHandler: conflicting subscription", "error", err)
+				return
+			}
+			if errors.Is(err, repositories.ErrValidation) {
+				writeJSONError(w, r, cfg.ValidationStatusCode, codeValidation, err.Error())
+				log.Error("upsertSubscriptionByExternalIDHandler: invalid subscription", "error", err)
 				return
 			}
-			w.WriteHeader(http.StatusNoContent)
-			log.Info("subscriptionsIDHandler: Deleted subscription", "id", id)
+			writeServerError(w, r, "failed to upsert subscription", err)
+			log.Error("upsertSubscriptionByExternalIDHandler: failed to upsert subscription", "external_id", externalID, "error", err)
+			return
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		_ = writeResponse(w, r, status, map[string]int{"id": id})
+		log.Info("upsertSubscriptionByExternalIDHandler: Upserted subscription", "external_id", externalID, "id", id, "created", created)
+	}
+}
 
-		default:
-			w.Header().Set("Allow", "GET, PUT, DELETE")
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			log.Error("subscriptionsIDHandler: Unsupported method", r.Method)
+// normalizeDatesBatchSize is the number of rows normalizeDatesHandler asks
+// the repository to fix per transaction.
+const normalizeDatesBatchSize = 500
+
+// @Summary Normalize stored dates
+// @Description Truncate start_date and end_date of all subscriptions to the first day of their month (admin maintenance). Only served when MAINTENANCE_ENABLED is true.
+// @Tags maintenance
+// @Produce json,application/msgpack
+// @Success 200 {object} map[string]int
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /subscriptions/maintenance/normalize-dates [post]
+func normalizeDatesDoc() {}
+
+// normalizeDatesHandler returns an http.HandlerFunc for the admin
+// maintenance endpoint that re-truncates stored subscription dates to the
+// first of the month. It responds with the number of rows that were changed.
+func normalizeDatesHandler(repo *repositories.SubscriptionsRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("normalizeDatesHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		updated, err := repo.NormalizeDates(r.Context(), normalizeDatesBatchSize)
+		if err != nil {
+			writeServerError(w, r, "failed to normalize dates", err)
+			log.Error("normalizeDatesHandler: failed to normalize dates", "error", err, "updated", updated)
+			return
+		}
+
+		if err := writeResponse(w, r, http.StatusOK, map[string]int{"updated": updated}); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+			log.Error("normalizeDatesHandler: failed to encode response", "error", err)
+			return
+		}
+		log.Info("normalizeDatesHandler: Normalized subscription dates", "updated", updated)
+	}
+}
+
+// @Summary Get connection pool statistics
+// @Description Snapshot of the database connection pool, for diagnosing connection exhaustion. Disabled with DEBUG_POOL_ENABLED=false.
+// @Tags debug
+// @Produce json,application/msgpack
+// @Success 200 {object} repositories.PoolStats
+// @Router /debug/pool [get]
+func debugPoolDoc() {}
+
+// debugPoolHandler returns an http.HandlerFunc for the /debug/pool endpoint,
+// which reports the current connection pool statistics of repo.
+func debugPoolHandler(repo *repositories.SubscriptionsRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.GetLogger(r.Context())
+		log.Info("debugPoolHandler: Received request", "method", r.Method, "path", r.URL.Path)
+		if err := writeResponse(w, r, http.StatusOK, repo.PoolStats()); err != nil {
+			log.Error("debugPoolHandler: failed to encode response", "error", err)
+			return
 		}
 	}
 }
 
+// registerRoutes registers the API handlers on mux. The debug and
+// maintenance endpoints are only registered when enabled in cfg.
+func registerRoutes(mux *http.ServeMux, repo *repositories.SubscriptionsRepository, cfg *config.Config) {
+	mux.HandleFunc("GET /subscriptions", listSubscriptionsHandler(repo, cfg))
+	mux.HandleFunc("POST /subscriptions", createSubscriptionHandler(repo, cfg))
+	mux.HandleFunc("DELETE /subscriptions", deleteUserSubscriptionsHandler(repo, cfg))
+	mux.HandleFunc("POST /subscriptions/batch", subscriptionsBatchHandler(repo, cfg))
+	mux.HandleFunc("GET /subscriptions/{id}", getSubscriptionHandler(repo, cfg))
+	mux.HandleFunc("PUT /subscriptions/{id}", updateSubscriptionHandler(repo, cfg))
+	mux.HandleFunc("PATCH /subscriptions/{id}", updateSubscriptionHandler(repo, cfg))
+	mux.HandleFunc("DELETE /subscriptions/{id}", deleteSubscriptionHandler(repo))
+	mux.HandleFunc("GET /subscriptions/{id}/{resource}", subscriptionTenureHandler(repo, cfg))
+	mux.HandleFunc("POST /subscriptions/{id}/restore", restoreSubscriptionHandler(repo))
+	mux.HandleFunc("GET /subscriptions/total", subscriptionsTotalHandler(repo, cfg))
+	mux.HandleFunc("GET /subscriptions/total/breakdown", subscriptionsTotalBreakdownHandler(repo, cfg))
+	mux.HandleFunc("GET /subscriptions/total/timeseries", subscriptionsTotalTimeseriesHandler(repo, cfg))
+	mux.HandleFunc("GET /subscriptions/trend", subscriptionsTrendHandler(repo, cfg))
+	mux.HandleFunc("GET /subscriptions/has-active", subscriptionsHasActiveHandler(repo, cfg))
+	mux.HandleFunc("GET /subscriptions/count", subscriptionsCountHandler(repo, cfg))
+	mux.HandleFunc("GET /subscriptions/expiring", subscriptionsExpiringHandler(repo, cfg))
+	mux.HandleFunc("GET /subscriptions/by-external/{externalID}", getSubscriptionByExternalIDHandler(repo, cfg))
+	mux.HandleFunc("PUT /subscriptions/by-external/{externalID}", upsertSubscriptionByExternalIDHandler(repo, cfg))
+	mux.HandleFunc("GET /users/{user_id}/subscriptions", userSubscriptionsHandler(repo, cfg))
+	if cfg.DebugPoolEnabled {
+		mux.HandleFunc("GET /debug/pool", debugPoolHandler(repo))
+	}
+	if cfg.MaintenanceEnabled {
+		mux.HandleFunc("POST /subscriptions/maintenance/normalize-dates", normalizeDatesHandler(repo))
+	}
+}
+
 // Start initializes the server routing and starts the HTTP server.
 //
-// It reads configuration using the internal config package, creates a
-// SubscriptionsRepository and registers handlers on a new ServeMux. The
-// function blocks until the HTTP server exits or returns an error.
-func Start(ctx context.Context) error {
+// It uses the configuration loaded by the caller, sets up tracing (see
+// tracing.Setup), creates a SubscriptionsRepository, starts the optional
+// background jobs and registers handlers on a new ServeMux. The function
+// blocks until the HTTP server exits or returns an error. On SIGINT or
+// SIGTERM the server stops accepting new connections and waits up to
+// SHUTDOWN_TIMEOUT for in-flight requests; background jobs are then stopped,
+// the database pool is closed and pending spans are flushed. HTTPS is served
+// instead of plain HTTP when TLS_CERT_FILE and TLS_KEY_FILE are set.
+func Start(ctx context.Context, cfg *config.Config) error {
 	log := logger.GetLogger(ctx)
+	ctx, stopSignals := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 	mux := http.NewServeMux()
-	cfg, err := config.New()
+	log.Info("lifecycle: config loaded", "phase", "startup", "port", cfg.Port, "max_inflight", cfg.MaxInflight, "expiry_job_interval", cfg.ExpiryJobInterval.String(), "log_level", cfg.LogLevel, "log_format", cfg.LogFormat)
+	shutdownTracing, err := tracing.Setup(ctx)
 	if err != nil {
-		return fmt.Errorf("start: failed to load config: %w", err)
+		return fmt.Errorf("start: failed to set up tracing: %w", err)
 	}
-	repo, err := repositories.NewSubscriptionsRepository(ctx, cfg.Postgres)
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			log.Error("lifecycle: failed to flush traces", "phase", "shutdown", "error", err)
+		}
+	}()
+	repo, err := repositories.NewSubscriptionsRepository(ctx, cfg.Postgres, repositories.Options{DateLayouts: cfg.DateInputFormats, DebugSQL: cfg.DebugSQL, QueryTimeout: cfg.QueryTimeout, MaxPrice: cfg.MaxPrice})
 	if err != nil {
 		return fmt.Errorf("start: failed to create subscriptions repository: %w", err)
 	}
+	defer func() {
+		repo.Close()
+		log.Info("lifecycle: pool closed", "phase", "shutdown")
+	}()
+	if version, dirty, err := repo.MigrationVersion(ctx); err != nil {
+		log.Warn("lifecycle: migration version unknown", "phase", "startup", "error", err)
+	} else {
+		log.Info("lifecycle: migrations applied", "phase", "startup", "version", version, "dirty", dirty)
+	}
 
-	mux.HandleFunc("/subscriptions", subscriptionsHandler(ctx, repo))
-	mux.HandleFunc("/subscriptions/", subscriptionsIDHandler(ctx, repo))
-	mux.HandleFunc("/subscriptions/total", subscriptionsTotalHandler(ctx, repo))
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+	if cfg.ExpiryJobInterval > 0 {
+		go runExpiryJob(jobsCtx, repo, cfg.ExpiryJobInterval)
+	}
 
-	log.Info("Starting server on port", "port", cfg.Port)
-	err = http.ListenAndServe(fmt.Sprintf(":%s", cfg.Port), mux)
-	if err != nil {
-		return fmt.Errorf("start: error while starting http server: %w", err)
+	registerRoutes(mux, repo, cfg)
+	// The generated spec names localhost:8080; clearing the host makes the
+	// Swagger UI send requests to whatever host and port served it.
+	api.SwaggerInfo.Host = ""
+	mux.Handle("GET /swagger/", httpSwagger.WrapHandler)
+	m := newMetrics(repo)
+	mux.Handle("GET /metrics", m.handler())
+
+	var handler http.Handler = routeErrors(mux)
+	if cfg.DebugSQL {
+		log.Warn("start: DEBUG_SQL is enabled, executed SQL is exposed in response headers; never use this in production")
+		handler = debugSQL(handler)
+	}
+	var inflight atomic.Int64
+	handler = inflightLimit(cfg.MaxInflight, &inflight, handler)
+	handler = rateLimit(ctx, cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.RateLimitTrustForwarded, handler)
+	handler = cors(cfg.CORSAllowedOrigins, handler)
+	handler = m.instrument(mux, handler)
+	handler = otelhttp.NewHandler(handler, "http.server", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + routeLabel(mux, r)
+	}))
+	// recoverPanic wraps every middleware but the two it relies on: requestID
+	// gives its log line the request ID and accessLog records the 500.
+	handler = recoverPanic(handler)
+	handler = accessLog(handler)
+	handler = requestID(ctx, handler)
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%s", cfg.Port),
+		Handler:      handler,
+		ReadTimeout:  cfg.HTTPReadTimeout,
+		WriteTimeout: cfg.HTTPWriteTimeout,
+		IdleTimeout:  cfg.HTTPIdleTimeout,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if cfg.TLSEnabled() {
+			serveErr <- srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+			return
+		}
+		serveErr <- srv.ListenAndServe()
+	}()
+	log.Info("lifecycle: server listening", "phase", "startup", "addr", srv.Addr, "tls", cfg.TLSEnabled())
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("start: error while starting http server: %w", err)
+		}
+	case <-ctx.Done():
+		log.Info("lifecycle: shutdown signal received", "phase", "shutdown", "timeout", cfg.ShutdownTimeout.String())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		log.Info("lifecycle: draining", "phase", "shutdown", "inflight", inflight.Load())
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("start: graceful shutdown failed: %w", err)
+		}
 	}
+	log.Info("lifecycle: server exited", "phase", "shutdown")
 	return nil
 }
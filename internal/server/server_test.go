@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"task_effective_mobile/internal/config"
+	"task_effective_mobile/internal/repositories"
+	"task_effective_mobile/pkg/logger"
+	"testing"
+)
+
+// auditRecord logs the total_cost_computed attributes of filter as JSON and
+// returns the decoded record without its time, level and message.
+func auditRecord(t *testing.T, filter repositories.TotalCostFilter) map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info(totalCostComputedEvent, totalCostAuditAttrs(filter)...)
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log output %q is not JSON: %v", buf.String(), err)
+	}
+	delete(record, "time")
+	delete(record, "level")
+	delete(record, "msg")
+	return record
+}
+
+func TestTotalCostAuditAttrs(t *testing.T) {
+	serviceName, currency, start, end := "netflix", "EUR", "01-2024", "12-2024"
+	hasServiceName := true
+	minPrice, maxPrice := 100, 500
+	filter := repositories.TotalCostFilter{
+		UserIDs:         []string{"u1", "u2"},
+		ServiceName:     &serviceName,
+		HasServiceName:  &hasServiceName,
+		StartDate:       &start,
+		EndDate:         &end,
+		ExcludeServices: []string{"spotify", "hbo"},
+		MinPrice:        &minPrice,
+		MaxPrice:        &maxPrice,
+		Currency:        &currency,
+		Fields:          map[string]string{"status": "active", "external_id": "ext-1"},
+	}
+
+	got := auditRecord(t, filter)
+
+	want := map[string]any{
+		"user_id":          "u1,u2",
+		"service_name":     "netflix",
+		"has_service_name": "true",
+		"exclude_service":  "spotify,hbo",
+		"currency":         "EUR",
+		"price":            map[string]any{"min": "100", "max": "500"},
+		"period":           map[string]any{"start": "01-2024", "end": "12-2024"},
+		"filter":           map[string]any{"status": "active", "external_id": "ext-1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("audit attributes = %v, want %v", got, want)
+	}
+}
+
+func TestTotalCostAuditAttrsUnappliedFilters(t *testing.T) {
+	got := auditRecord(t, repositories.TotalCostFilter{})
+
+	want := map[string]any{
+		"user_id":          "all",
+		"service_name":     "all",
+		"has_service_name": "all",
+		"exclude_service":  "all",
+		"currency":         "all",
+		"price":            map[string]any{"min": "all", "max": "all"},
+		"period":           map[string]any{"start": "all", "end": "all"},
+		"filter":           "all",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("audit attributes = %v, want %v", got, want)
+	}
+}
+
+// newTestMux returns a mux with every route registered, including the
+// optional ones. The handlers get no repository, so only requests rejected
+// before a query may be served through it.
+func newTestMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	registerRoutes(mux, nil, &config.Config{DebugPoolEnabled: true, MaintenanceEnabled: true})
+	return mux
+}
+
+func TestRegisterRoutes(t *testing.T) {
+	mux := newTestMux()
+	tests := []struct {
+		method, path, pattern string
+	}{
+		{http.MethodGet, "/subscriptions/5/tenure", "GET /subscriptions/{id}/{resource}"},
+		{http.MethodGet, "/subscriptions/total/breakdown", "GET /subscriptions/total/breakdown"},
+		{http.MethodGet, "/subscriptions/by-external/ext-1", "GET /subscriptions/by-external/{externalID}"},
+		{http.MethodGet, "/subscriptions/by-external/tenure", "GET /subscriptions/by-external/{externalID}"},
+		{http.MethodPut, "/subscriptions/by-external/ext-1", "PUT /subscriptions/by-external/{externalID}"},
+	}
+	for _, tt := range tests {
+		_, pattern := mux.Handler(httptest.NewRequest(tt.method, tt.path, nil))
+		if pattern != tt.pattern {
+			t.Errorf("%s %s is routed to %q, want %q", tt.method, tt.path, pattern, tt.pattern)
+		}
+	}
+}
+
+func TestTenureUnknownResource(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/5/history", nil)
+	req = req.WithContext(logger.WithLogger(req.Context(), slog.New(slog.DiscardHandler)))
+
+	newTestMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /subscriptions/5/history status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"task_effective_mobile/internal/repositories"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// contentTypeMergePatch is the media type of RFC 7386 JSON Merge Patch
+// documents accepted by the update endpoint.
+const contentTypeMergePatch = "application/merge-patch+json"
+
+// createSubscriptionRequest is the JSON body accepted when creating a
+// subscription. Dates are expected in "MM-YYYY" format; EndDate may be
+// empty for an open-ended subscription. Currency (default USD) and ExternalID
+// are optional.
+type createSubscriptionRequest struct {
+	ServiceName string `json:"service_name"`
+	Price       int    `json:"price"`
+	Currency    string `json:"currency"`
+	UserID      string `json:"user_id"`
+	StartDate   string `json:"start_date"`
+	EndDate     string `json:"end_date"`
+	ExternalID  string `json:"external_id"`
+}
+
+// currentMonth returns the current month in MM-YYYY format, the default of
+// omitted month fields and parameters. It is taken in UTC, like the months
+// the database compares against, so that the defaults do not depend on the
+// server's time zone.
+func currentMonth() string {
+	return time.Now().UTC().Format("01-2006")
+}
+
+// validate checks that the required fields of the request are present, that
+// user_id is a UUID and that price is non-negative.
+//
+// When defaultStart is true an omitted StartDate is filled in with the
+// current UTC month (MM-YYYY) instead of being reported as missing. This is
+// the behavior enabled by the CREATE_DEFAULT_START setting.
+func (req *createSubscriptionRequest) validate(defaultStart bool) error {
+	if req.StartDate == "" && defaultStart {
+		req.StartDate = currentMonth()
+	}
+	if strings.TrimSpace(req.ServiceName) == "" || req.UserID == "" || req.StartDate == "" {
+		return errors.New("missing required fields")
+	}
+	if err := validateUserID(req.UserID); err != nil {
+		return err
+	}
+	if req.Price < 0 {
+		return errors.New("price must be non-negative")
+	}
+	return nil
+}
+
+// validateUserID reports an error when userID is not a valid UUID. It is
+// shared by every endpoint accepting a user_id so they reject malformed
+// values the same way.
+func validateUserID(userID string) error {
+	if _, err := uuid.Parse(userID); err != nil {
+		return errors.New("user_id must be a valid UUID")
+	}
+	return nil
+}
+
+// updateSubscriptionRequest is the body of a partial subscription update.
+// Nil fields are left unchanged. For a plain JSON body an empty EndDate or
+// ExternalID clears the value. Version is the subscription version the
+// update is based on, unless it is sent in the If-Match header.
+type updateSubscriptionRequest struct {
+	ServiceName *string `json:"service_name"`
+	Price       *int    `json:"price"`
+	Currency    *string `json:"currency"`
+	UserID      *string `json:"user_id"`
+	StartDate   *string `json:"start_date"`
+	EndDate     *string `json:"end_date"`
+	ExternalID  *string `json:"external_id"`
+	Version     *int    `json:"version"`
+}
+
+// isMergePatch reports whether the request body is a JSON Merge Patch
+// document according to its Content-Type header.
+func isMergePatch(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == contentTypeMergePatch
+}
+
+// applyMergePatch fills req from the members of a JSON Merge Patch object
+// (RFC 7386). An absent member leaves its field unchanged and a null member
+// clears it. Only end_date and external_id are nullable, so null for any
+// other known field is an error. Unknown members are ignored, as they are for a plain update.
+func (req *updateSubscriptionRequest) applyMergePatch(patch map[string]json.RawMessage) error {
+	fields := map[string]any{
+		"service_name": &req.ServiceName,
+		"price":        &req.Price,
+		"currency":     &req.Currency,
+		"user_id":      &req.UserID,
+		"start_date":   &req.StartDate,
+		"end_date":     &req.EndDate,
+		"external_id":  &req.ExternalID,
+		"version":      &req.Version,
+	}
+	nullable := map[string]**string{
+		"end_date":    &req.EndDate,
+		"external_id": &req.ExternalID,
+	}
+	for name, raw := range patch {
+		dest, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if string(raw) == "null" {
+			field, ok := nullable[name]
+			if !ok {
+				return fmt.Errorf("%s cannot be null", name)
+			}
+			cleared := ""
+			*field = &cleared
+			continue
+		}
+		if err := json.Unmarshal(raw, dest); err != nil {
+			return fmt.Errorf("invalid value for %s", name)
+		}
+	}
+	return nil
+}
+
+// errVersionRequired is returned by updateVersion when an update names no
+// version to base on; it is answered with 428 Precondition Required.
+var errVersionRequired = errors.New("version is required: send it in the If-Match header or the version field")
+
+// updateVersion returns the subscription version an update is based on. It
+// is read from the If-Match header, holding the ETag of a previous read such
+// as "3" (a bare number is accepted too), or from the version field of the
+// body. When both are given they must agree.
+func updateVersion(r *http.Request, field *int) (int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		if field == nil {
+			return 0, errVersionRequired
+		}
+		return *field, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(header, `"`))
+	if err != nil {
+		return 0, fmt.Errorf("If-Match must be a subscription ETag such as \"1\", got %s", header)
+	}
+	if field != nil && *field != version {
+		return 0, fmt.Errorf("version %d does not match If-Match %s", *field, header)
+	}
+	return version, nil
+}
+
+// etag formats a subscription version as the strong ETag sent with reads and
+// updates and expected back in If-Match.
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// maxServiceNameLikeLen bounds the service_name_like search, matching the
+// length of the service_name column.
+const maxServiceNameLikeLen = 255
+
+// Page size bounds of the subscription listing.
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// parsePageParam reads the non-negative integer query parameter name,
+// returning def when it is absent.
+func parsePageParam(q url.Values, name string, def int) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// parsePage reads the limit and offset query parameters of a paginated
+// listing. limit defaults to defaultPageLimit, must be positive and is capped
+// at maxPageLimit; offset defaults to 0.
+func parsePage(q url.Values) (limit int, offset int, err error) {
+	limit, err = parsePageParam(q, "limit", defaultPageLimit)
+	if err == nil && limit == 0 {
+		err = errors.New("invalid limit: must be positive")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset, err = parsePageParam(q, "offset", 0); err != nil {
+		return 0, 0, err
+	}
+	return min(limit, maxPageLimit), offset, nil
+}
+
+// parsePriceRange reads the optional min_price and max_price query
+// parameters. Absent parameters yield nil bounds; the range itself is
+// checked by the repository.
+func parsePriceRange(q url.Values) (*int, *int, error) {
+	var bounds [2]*int
+	for i, name := range []string{"min_price", "max_price"} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("invalid %s: must be a non-negative integer", name)
+		}
+		bounds[i] = &n
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// parseMonthParam reads the optional query parameter name as a month with
+// parse, normally the repository's ParseMonth, so that it accepts the same
+// formats as start_date and end_date. It returns the first day of that month
+// in UTC or nil when the parameter is absent.
+func parseMonthParam(q url.Values, name string, parse func(string) (time.Time, error)) (*time.Time, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return &t, nil
+}
+
+// parseTotalCostFilter reads the filters shared by the total cost endpoints
+// from q. user_id may be repeated or hold comma-separated ids, each of which
+// must be a UUID. An empty service_name is treated as absent; filtering on
+// missing service names is done with has_service_name=false.
+func parseTotalCostFilter(q url.Values) (repositories.TotalCostFilter, error) {
+	var filter repositories.TotalCostFilter
+	for _, v := range q["user_id"] {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id == "" {
+				continue
+			}
+			if err := validateUserID(id); err != nil {
+				return filter, fmt.Errorf("%w, got %q", err, id)
+			}
+			filter.UserIDs = append(filter.UserIDs, id)
+		}
+	}
+	if v := q.Get("service_name"); v != "" {
+		filter.ServiceName = &v
+	}
+	if v := q.Get("currency"); v != "" {
+		filter.Currency = &v
+	}
+	if v := q.Get("has_service_name"); v != "" {
+		has, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, errors.New("invalid has_service_name: must be true or false")
+		}
+		filter.HasServiceName = &has
+	}
+	if v := q.Get("start_date"); v != "" {
+		filter.StartDate = &v
+	}
+	if v := q.Get("end_date"); v != "" {
+		filter.EndDate = &v
+	}
+	for _, v := range q["exclude_service"] {
+		if v != "" {
+			filter.ExcludeServices = append(filter.ExcludeServices, v)
+		}
+	}
+	minPrice, maxPrice, err := parsePriceRange(q)
+	if err != nil {
+		return filter, err
+	}
+	filter.MinPrice, filter.MaxPrice = minPrice, maxPrice
+	for key, values := range q {
+		column, ok := strings.CutPrefix(key, "filter[")
+		if !ok || !strings.HasSuffix(column, "]") || len(values) == 0 {
+			continue
+		}
+		if filter.Fields == nil {
+			filter.Fields = make(map[string]string)
+		}
+		filter.Fields[strings.TrimSuffix(column, "]")] = values[0]
+	}
+	return filter, nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	str := func(s string) *string { return &s }
+	num := func(n int) *int { return &n }
+
+	tests := []struct {
+		field    string
+		set      string
+		wantSet  any
+		nullable bool
+		get      func(req *updateSubscriptionRequest) any
+	}{
+		{"service_name", `"netflix"`, str("netflix"), false, func(req *updateSubscriptionRequest) any { return req.ServiceName }},
+		{"price", `400`, num(400), false, func(req *updateSubscriptionRequest) any { return req.Price }},
+		{"currency", `"EUR"`, str("EUR"), false, func(req *updateSubscriptionRequest) any { return req.Currency }},
+		{"user_id", `"60601fee-2bf1-4721-ae6f-7636e79a0cba"`, str("60601fee-2bf1-4721-ae6f-7636e79a0cba"), false, func(req *updateSubscriptionRequest) any { return req.UserID }},
+		{"start_date", `"07-2025"`, str("07-2025"), false, func(req *updateSubscriptionRequest) any { return req.StartDate }},
+		{"end_date", `"12-2025"`, str("12-2025"), true, func(req *updateSubscriptionRequest) any { return req.EndDate }},
+		{"external_id", `"ext-1"`, str("ext-1"), true, func(req *updateSubscriptionRequest) any { return req.ExternalID }},
+		{"version", `3`, num(3), false, func(req *updateSubscriptionRequest) any { return req.Version }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field+"/absent", func(t *testing.T) {
+			var req updateSubscriptionRequest
+			if err := req.applyMergePatch(map[string]json.RawMessage{}); err != nil {
+				t.Fatalf("applyMergePatch({}) error: %v", err)
+			}
+			if got := tt.get(&req); !reflect.ValueOf(got).IsNil() {
+				t.Errorf("%s = %v, want nil (unchanged)", tt.field, got)
+			}
+		})
+		t.Run(tt.field+"/null", func(t *testing.T) {
+			var req updateSubscriptionRequest
+			err := req.applyMergePatch(map[string]json.RawMessage{tt.field: json.RawMessage("null")})
+			if !tt.nullable {
+				if err == nil || err.Error() != tt.field+" cannot be null" {
+					t.Errorf("applyMergePatch(%s: null) error = %v, want %q", tt.field, err, tt.field+" cannot be null")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyMergePatch(%s: null) error: %v", tt.field, err)
+			}
+			if got := tt.get(&req); !reflect.DeepEqual(got, str("")) {
+				t.Errorf("%s = %v, want a pointer to \"\" (cleared)", tt.field, got)
+			}
+		})
+		t.Run(tt.field+"/set", func(t *testing.T) {
+			var req updateSubscriptionRequest
+			if err := req.applyMergePatch(map[string]json.RawMessage{tt.field: json.RawMessage(tt.set)}); err != nil {
+				t.Fatalf("applyMergePatch(%s: %s) error: %v", tt.field, tt.set, err)
+			}
+			if got := tt.get(&req); !reflect.DeepEqual(got, tt.wantSet) {
+				t.Errorf("%s = %v, want %v", tt.field, got, tt.wantSet)
+			}
+		})
+	}
+}
+
+func TestApplyMergePatchInvalidValue(t *testing.T) {
+	var req updateSubscriptionRequest
+	err := req.applyMergePatch(map[string]json.RawMessage{"price": json.RawMessage(`"ten"`)})
+	if err == nil || err.Error() != "invalid value for price" {
+		t.Errorf("applyMergePatch(price: \"ten\") error = %v, want %q", err, "invalid value for price")
+	}
+}
+
+func TestApplyMergePatchIgnoresUnknownMembers(t *testing.T) {
+	var req updateSubscriptionRequest
+	if err := req.applyMergePatch(map[string]json.RawMessage{"id": json.RawMessage("null")}); err != nil {
+		t.Errorf("applyMergePatch(id: null) error = %v, want nil", err)
+	}
+}
+
+func TestParseMonthParam(t *testing.T) {
+	want := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	parse := func(v string) (time.Time, error) {
+		if v != "2024-03" {
+			return time.Time{}, errors.New("unsupported format")
+		}
+		return want, nil
+	}
+
+	got, err := parseMonthParam(url.Values{"active_on": {"2024-03"}}, "active_on", parse)
+	if err != nil || got == nil || !got.Equal(want) {
+		t.Errorf("parseMonthParam(2024-03) = %v, %v, want %s", got, err, want)
+	}
+	if got, err := parseMonthParam(url.Values{}, "active_on", parse); got != nil || err != nil {
+		t.Errorf("parseMonthParam without the parameter = %v, %v, want nil, nil", got, err)
+	}
+	_, err = parseMonthParam(url.Values{"active_on": {"bad"}}, "active_on", parse)
+	if err == nil || err.Error() != "invalid active_on: unsupported format" {
+		t.Errorf("parseMonthParam(bad) error = %v, want %q", err, "invalid active_on: unsupported format")
+	}
+}
+
+func TestCurrentMonthIsUTC(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.FixedZone("UTC+14", 14*60*60)
+
+	before := time.Now().UTC().Format("01-2006")
+	got := currentMonth()
+	after := time.Now().UTC().Format("01-2006")
+
+	if got != before && got != after {
+		t.Errorf("currentMonth() = %q, want the UTC month %q", got, before)
+	}
+}
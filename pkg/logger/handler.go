@@ -0,0 +1,92 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Supported values of the format argument of New.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Named values of the output argument of OpenOutput; any other value is a
+// file path.
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+)
+
+// levels maps the accepted level names to slog levels.
+var levels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// New builds a logger writing to w at the given level (debug, info, warn or
+// error) in the given format (json or text). Both names are case-insensitive.
+//
+// New always returns a usable logger: an unknown level falls back to info
+// and an unknown format to json. In that case the returned error describes
+// the rejected values so the caller can log a warning with the new logger.
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var errs []error
+	lvl, ok := levels[strings.ToLower(level)]
+	if !ok {
+		lvl = slog.LevelInfo
+		errs = append(errs, fmt.Errorf("unknown log level %q, using info", level))
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		handler = slog.NewJSONHandler(w, opts)
+		errs = append(errs, fmt.Errorf("unknown log format %q, using json", format))
+	}
+	return slog.New(handler), errors.Join(errs...)
+}
+
+// OpenOutput returns the destination of the logs named by output: standard
+// output for "stdout" or an empty value, standard error for "stderr", and
+// otherwise the file at that path, created if needed and appended to.
+//
+// Closing the returned writer syncs and closes the file; it does nothing for
+// the standard streams. When the file cannot be opened, OpenOutput falls back
+// to standard output and returns the error alongside it, as New does.
+func OpenOutput(output string) (io.WriteCloser, error) {
+	switch strings.ToLower(output) {
+	case "", OutputStdout:
+		return nopCloser{os.Stdout}, nil
+	case OutputStderr:
+		return nopCloser{os.Stderr}, nil
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nopCloser{os.Stdout}, fmt.Errorf("cannot open log file %q, using stdout: %w", output, err)
+	}
+	return syncCloser{f}, nil
+}
+
+// nopCloser is a log output that must not be closed, such as os.Stdout.
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// syncCloser flushes a log file to disk before closing it.
+type syncCloser struct{ *os.File }
+
+func (f syncCloser) Close() error {
+	return errors.Join(f.Sync(), f.File.Close())
+}
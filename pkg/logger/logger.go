@@ -27,11 +27,20 @@ func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
 
 // GetLogger retrieves the *slog.Logger stored in ctx using WithLogger.
 //
-// The function performs a type assertion and returns the logger pointer. If
-// no logger is present in the context the type assertion will panic; callers
-// should ensure that WithLogger was used to populate the context before
-// calling GetLogger (for example by establishing the logger in main).
+// When no logger is present in the context (for example in tests or in
+// goroutines started with a fresh context) the default slog logger is
+// returned, so the function never panics.
 func GetLogger(ctx context.Context) *slog.Logger {
-	logger := ctx.Value(loggerKey)
-	return logger.(*slog.Logger)
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok && logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With returns a new context carrying the logger of ctx enriched with args,
+// as passed to slog.Logger.With. Loggers obtained with GetLogger from the
+// returned context, and from contexts derived from it, include these
+// attributes in every record. Successive calls accumulate attributes.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, GetLogger(ctx).With(args...))
 }
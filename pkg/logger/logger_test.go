@@ -0,0 +1,56 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestGetLoggerWithoutLogger(t *testing.T) {
+	log := GetLogger(context.Background())
+	if log == nil {
+		t.Fatal("GetLogger(context.Background()) = nil, want a usable logger")
+	}
+	log.Info("logging without a stored logger must not panic")
+}
+
+func TestGetLoggerReturnsStoredLogger(t *testing.T) {
+	want := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	if got := GetLogger(WithLogger(context.Background(), want)); got != want {
+		t.Errorf("GetLogger() = %p, want the stored logger %p", got, want)
+	}
+}
+
+func TestWithAccumulatesAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := WithLogger(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)))
+	ctx = With(ctx, "request_id", "req-1")
+	ctx = With(ctx, "user_id", "user-1", "sub_id", 7)
+
+	GetLogger(ctx).Info("message")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log output %q is not JSON: %v", buf.String(), err)
+	}
+	want := map[string]any{"request_id": "req-1", "user_id": "user-1", "sub_id": float64(7)}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v in %s", key, record[key], value, buf.String())
+		}
+	}
+}
+
+func TestWithDoesNotChangeParentContext(t *testing.T) {
+	var buf bytes.Buffer
+	parent := WithLogger(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)))
+	_ = With(parent, "request_id", "req-1")
+
+	GetLogger(parent).Info("message")
+
+	if bytes.Contains(buf.Bytes(), []byte("request_id")) {
+		t.Errorf("parent logger output %s contains an attribute added to a derived context", buf.String())
+	}
+}
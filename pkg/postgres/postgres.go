@@ -5,11 +5,15 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"task_effective_mobile/pkg/logger"
+	"task_effective_mobile/pkg/tracing"
+	"time"
 
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -17,37 +21,152 @@ import (
 //
 // The fields are tagged for mapping from environment variables (e.g.
 // POSTGRES_HOST, POSTGRES_PORT, POSTGRES_USER, POSTGRES_PASSWORD,
-// POSTGRES_DB) by the application's configuration loader.
+// POSTGRES_DB) by the application's configuration loader. MaxConnLifetime
+// and HealthCheckPeriod are read from POSTGRES_MAX_CONN_LIFETIME and
+// POSTGRES_HEALTH_CHECK_PERIOD as Go durations.
 type Config struct {
 	Host     string `env:"POSTGRES_HOST"`
 	Port     string `env:"POSTGRES_PORT"`
 	Username string `env:"POSTGRES_USER"`
 	Password string `env:"POSTGRES_PASSWORD"`
 	Database string `env:"POSTGRES_DB"`
+	// SSLMode is the libpq sslmode of the connection, one of the values
+	// accepted by ValidSSLMode.
+	SSLMode string `env:"POSTGRES_SSLMODE" env-default:"disable"`
 
-	MinConns int32 `env:"POSTGRES_MIN_CONNS"`
-	MaxConns int32 `env:"POSTGRES_MAX_CONNS"`
+	MinConns int32 `env:"POSTGRES_MIN_CONNS" env-default:"2"`
+	MaxConns int32 `env:"POSTGRES_MAX_CONNS" env-default:"10"`
+
+	// MaxConnLifetime is how long a connection is kept before it is closed
+	// and replaced, so server-side state does not go stale and failovers are
+	// picked up. HealthCheckPeriod is how often idle connections are checked.
+	MaxConnLifetime   time.Duration `env:"POSTGRES_MAX_CONN_LIFETIME" env-default:"1h"`
+	HealthCheckPeriod time.Duration `env:"POSTGRES_HEALTH_CHECK_PERIOD" env-default:"1m"`
+
+	// ConnectRetries is how many more times New tries to reach the database
+	// after a failed first attempt, waiting ConnectRetryDelay before the
+	// first retry and twice as long before each next one, at most 30s. They
+	// are read from DB_CONNECT_RETRIES and DB_CONNECT_RETRY_DELAY.
+	ConnectRetries    int           `env:"DB_CONNECT_RETRIES" env-default:"5"`
+	ConnectRetryDelay time.Duration `env:"DB_CONNECT_RETRY_DELAY" env-default:"1s"`
+}
+
+// maxConnectRetryDelay caps the exponential backoff between connection
+// attempts.
+const maxConnectRetryDelay = 30 * time.Second
+
+// sslModes lists the sslmode values understood by libpq and pgx.
+var sslModes = map[string]bool{
+	"disable":     true,
+	"allow":       true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// ValidSSLMode reports whether mode is a valid libpq sslmode value.
+func ValidSSLMode(mode string) bool {
+	return sslModes[mode]
+}
+
+// dsn builds the connection URL of c. The credentials and query parameters
+// are percent-encoded, so a password may contain characters such as '@',
+// '/' or '?'. Zero values that pgx would reject are replaced, so even a
+// zero Config yields a URL that parses: an empty SSLMode becomes "disable",
+// MaxConns is raised to at least 1 and MinConns kept within [0, MaxConns],
+// and an empty Port leaves the pgx default port.
+func (c Config) dsn() string {
+	sslMode := c.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	maxConns := max(c.MaxConns, 1)
+	minConns := min(max(c.MinConns, 0), maxConns)
+	query := url.Values{}
+	query.Set("sslmode", sslMode)
+	query.Set("pool_min_conns", strconv.FormatInt(int64(minConns), 10))
+	query.Set("pool_max_conns", strconv.FormatInt(int64(maxConns), 10))
+	host := c.Host
+	if c.Port != "" {
+		host = net.JoinHostPort(c.Host, c.Port)
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.Username, c.Password),
+		Host:     host,
+		Path:     "/" + c.Database,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
 }
 
 // New creates and returns a pgx connection pool configured according to c.
 //
 // The provided context is used for pool creation and the service parameter
 // is used for logging context only. Returned pool should be closed by the
-// caller when no longer needed.
+// caller when no longer needed. An empty SSLMode means "disable" and a
+// MaxConns below 1, which pgx rejects, is raised to 1 (see dsn), so a zero
+// Config is accepted. A zero MaxConnLifetime or HealthCheckPeriod keeps the
+// pgx default. Every query is traced as a child span of the span in its context.
+//
+// The database often is not ready yet when the service starts, so New pings
+// it and retries a failed attempt up to c.ConnectRetries times with
+// exponential backoff (see Config), logging every attempt. The error of the
+// last attempt is returned once the retries are exhausted, or as soon as ctx
+// is done.
 func New(ctx context.Context, c Config, service string) (*pgxpool.Pool, error) {
 	log := logger.GetLogger(ctx)
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&pool_min_conns=%d&pool_max_conns=%d",
-		c.Username,
-		c.Password,
-		c.Host,
-		c.Port,
-		c.Database,
-		c.MinConns,
-		c.MaxConns)
-	conn, err := pgxpool.New(ctx, connString)
+	if c.SSLMode != "" && !ValidSSLMode(c.SSLMode) {
+		return nil, fmt.Errorf("new: invalid sslmode %q", c.SSLMode)
+	}
+	poolConfig, err := pgxpool.ParseConfig(c.dsn())
 	if err != nil {
-		return nil, fmt.Errorf("new: failed to connect to postgres: %w", err)
+		return nil, fmt.Errorf("new: failed to parse connection config: %w", err)
+	}
+	if c.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = c.MaxConnLifetime
+	}
+	if c.HealthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = c.HealthCheckPeriod
+	}
+	poolConfig.ConnConfig.Tracer = tracing.QueryTracer{}
+
+	attempts := max(c.ConnectRetries, 0) + 1
+	delay := c.ConnectRetryDelay
+	var conn *pgxpool.Pool
+	for attempt := 1; ; attempt++ {
+		log.Info("lifecycle: connecting to postgres", "phase", "startup", "service", service, "attempt", attempt, "attempts", attempts)
+		conn, err = connect(ctx, poolConfig)
+		if err == nil {
+			break
+		}
+		if attempt == attempts {
+			return nil, fmt.Errorf("new: failed to connect to postgres after %d attempts: %w", attempts, err)
+		}
+		log.Warn("lifecycle: postgres connection failed, retrying", "phase", "startup", "service", service, "attempt", attempt, "retry_in", delay.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("new: connecting to postgres interrupted: %w", errors.Join(ctx.Err(), err))
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxConnectRetryDelay)
 	}
-	log.Info(fmt.Sprintf("connected to %s", service))
+	log.Info("lifecycle: pool connected", "phase", "startup", "service", service, "min_conns", conn.Config().MinConns, "max_conns", conn.Config().MaxConns, "max_conn_lifetime", conn.Config().MaxConnLifetime.String(), "health_check_period", conn.Config().HealthCheckPeriod.String())
 	return conn, nil
 }
+
+// connect creates a pool from poolConfig and pings the database, since pool
+// creation alone does not open a connection. The pool is closed when the
+// ping fails.
+func connect(ctx context.Context, poolConfig *pgxpool.Config) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
@@ -0,0 +1,125 @@
+package postgres
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestDSNRoundTripsSpecialCharacters(t *testing.T) {
+	c := Config{
+		Host:     "db.example.com",
+		Port:     "6432",
+		Username: "us@er",
+		Password: "p@ss/w?rd",
+		Database: "subscriptions_db",
+		SSLMode:  "disable",
+		MinConns: 2,
+		MaxConns: 10,
+	}
+	parsed, err := pgxpool.ParseConfig(c.dsn())
+	if err != nil {
+		t.Fatalf("ParseConfig(%q) error: %v", c.dsn(), err)
+	}
+	conn := parsed.ConnConfig
+	if conn.User != c.Username {
+		t.Errorf("User = %q, want %q", conn.User, c.Username)
+	}
+	if conn.Password != c.Password {
+		t.Errorf("Password = %q, want %q", conn.Password, c.Password)
+	}
+	if conn.Host != c.Host {
+		t.Errorf("Host = %q, want %q", conn.Host, c.Host)
+	}
+	if conn.Port != 6432 {
+		t.Errorf("Port = %d, want 6432", conn.Port)
+	}
+	if conn.Database != c.Database {
+		t.Errorf("Database = %q, want %q", conn.Database, c.Database)
+	}
+}
+
+func TestSSLModeDefaultsToDisable(t *testing.T) {
+	t.Setenv("POSTGRES_SSLMODE", "")
+	os.Unsetenv("POSTGRES_SSLMODE")
+	var c Config
+	if err := cleanenv.ReadEnv(&c); err != nil {
+		t.Fatalf("ReadEnv error: %v", err)
+	}
+	if c.SSLMode != "disable" {
+		t.Errorf("SSLMode = %q, want the default %q", c.SSLMode, "disable")
+	}
+}
+
+func TestDSNContainsSSLMode(t *testing.T) {
+	for mode := range sslModes {
+		u, err := url.Parse(Config{Host: "localhost", Port: "5432", SSLMode: mode}.dsn())
+		if err != nil {
+			t.Fatalf("dsn() with sslmode %q does not parse: %v", mode, err)
+		}
+		if got := u.Query().Get("sslmode"); got != mode {
+			t.Errorf("dsn() sslmode = %q, want %q", got, mode)
+		}
+	}
+}
+
+func TestInvalidSSLModeIsRejected(t *testing.T) {
+	if ValidSSLMode("") {
+		t.Error("ValidSSLMode(\"\") = true, want false")
+	}
+	for _, mode := range []string{"on", "DISABLE", "verify_full"} {
+		if ValidSSLMode(mode) {
+			t.Errorf("ValidSSLMode(%q) = true, want false", mode)
+		}
+		_, err := New(context.Background(), Config{Host: "localhost", Port: "5432", SSLMode: mode, MaxConns: 1}, "test")
+		if err == nil || !strings.Contains(err.Error(), "invalid sslmode") {
+			t.Errorf("New with sslmode %q error = %v, want an invalid sslmode error", mode, err)
+		}
+	}
+}
+
+func TestZeroConfigDSN(t *testing.T) {
+	dsn := Config{}.dsn()
+	parsed, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("ParseConfig(%q) error: %v", dsn, err)
+	}
+	if parsed.MaxConns != 1 {
+		t.Errorf("MaxConns = %d, want 1", parsed.MaxConns)
+	}
+	if parsed.MinConns != 0 {
+		t.Errorf("MinConns = %d, want 0", parsed.MinConns)
+	}
+
+	// With a canceled context New fails on the connection attempt, after the
+	// config has been validated and parsed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = New(ctx, Config{}, "test")
+	if err == nil || strings.Contains(err.Error(), "invalid sslmode") || strings.Contains(err.Error(), "failed to parse") {
+		t.Errorf("New with a zero Config error = %v, want only a connection error", err)
+	}
+}
+
+func TestEmptyEnvConfigDSN(t *testing.T) {
+	for _, name := range []string{"POSTGRES_HOST", "POSTGRES_PORT", "POSTGRES_USER", "POSTGRES_PASSWORD", "POSTGRES_DB", "POSTGRES_SSLMODE", "POSTGRES_MIN_CONNS", "POSTGRES_MAX_CONNS"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	var c Config
+	if err := cleanenv.ReadEnv(&c); err != nil {
+		t.Fatalf("ReadEnv error: %v", err)
+	}
+	parsed, err := pgxpool.ParseConfig(c.dsn())
+	if err != nil {
+		t.Fatalf("ParseConfig(%q) error: %v", c.dsn(), err)
+	}
+	if parsed.MinConns != 2 || parsed.MaxConns != 10 {
+		t.Errorf("pool size = %d..%d, want the defaults 2..10", parsed.MinConns, parsed.MaxConns)
+	}
+}
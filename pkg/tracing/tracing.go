@@ -0,0 +1,60 @@
+// Package tracing configures OpenTelemetry tracing for the service and
+// provides the pgx query tracer that reports each database query as a span.
+//
+// Exporting is configured entirely by the standard OTEL_* environment
+// variables. When no OTLP endpoint is configured the global no-op tracer
+// provider is kept, so instrumented code costs next to nothing.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracerName identifies the instrumentation of this service in spans.
+const tracerName = "task_effective_mobile"
+
+// enabled reports whether the OTEL_* environment asks for traces to be
+// exported: an OTLP endpoint is set, the SDK is not disabled and the traces
+// exporter is not "none".
+func enabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	if strings.EqualFold(os.Getenv("OTEL_TRACES_EXPORTER"), "none") {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup installs a global tracer provider exporting spans over OTLP/HTTP,
+// configured by the standard OTEL_* environment variables (endpoint, headers,
+// service name, sampler, ...), and the W3C trace context propagator.
+//
+// When tracing is not enabled (see enabled) Setup changes nothing. The
+// returned function flushes pending spans and stops the exporter; it must be
+// called on shutdown and is safe to call in both cases.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Setup: failed to create OTLP exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.Default()),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}